@@ -1,11 +1,22 @@
 package sgf
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
+	"unicode/utf8"
 )
 
 func init() {
@@ -681,3 +692,1894 @@ func TestPercentageSignInComment(t *testing.T) {
 		t.Errorf("percentage sign not serialized correctly: %s", s.SGF())
 	}
 }
+
+func TestDecoder(t *testing.T) {
+	fmt.Printf("TestDecoder\n")
+
+	infile, err := os.Open("test_kifu/collection.sgf")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	defer infile.Close()
+
+	decoder := NewDecoder(iotest.OneByteReader(infile))
+	expectations := []int{44, 244, 3793}
+
+	for i := 0; ; i++ {
+		root, err := decoder.Decode()
+		if err == io.EOF {
+			if i != len(expectations) {
+				t.Errorf("Decoder returned %d trees, expected %d", i, len(expectations))
+			}
+			break
+		}
+		if err != nil {
+			t.Errorf(err.Error())
+			return
+		}
+		if i >= len(expectations) || root.TreeSize() != expectations[i] {
+			t.Errorf("A tree was not of expected size")
+		}
+	}
+
+	sgf := "(;GM[1]FF[4]SZ[19];B[dd](;W[pp])(;W[pd];B[dp]))"
+	root, err := LoadReader(strings.NewReader(sgf))
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	if root.SGF() != sgf {
+		t.Errorf("LoadReader() did not round-trip: %s", root.SGF())
+	}
+
+	_, err = LoadReader(strings.NewReader("  \n  "))
+	if err == nil {
+		t.Errorf("LoadReader() did not fail on empty input")
+	}
+}
+
+func TestParseError(t *testing.T) {
+	fmt.Printf("TestParseError\n")
+
+	_, err := LoadSGF("(;GM[1]FF[4]\n;B[dd]\n(;W[pp]) (;W[pd]; B[dp] % ))")
+
+	perr, ok := err.(*ParseError)
+	if ok == false {
+		t.Errorf("Expected a *ParseError, got %v", err)
+		return
+	}
+
+	if perr.Line != 3 || perr.Column != 25 || perr.Offset != 44 || perr.Token != "%" {
+		t.Errorf("ParseError location not as expected: %d:%d (%d) %q", perr.Line, perr.Column, perr.Offset, perr.Token)
+	}
+
+	if len(perr.Path) != 3 || perr.Path[0] != 0 || perr.Path[1] != 1 || perr.Path[2] != 0 {
+		t.Errorf("ParseError path not as expected: %v", perr.Path)
+	}
+
+	_, err = LoadSGF("(;C[foo\\")
+
+	perr, ok = err.(*ParseError)
+	if ok == false {
+		t.Errorf("Expected a *ParseError, got %v", err)
+		return
+	}
+
+	if perr.Offset != 8 || perr.Token != "" || len(perr.Path) != 0 || perr.Path == nil {
+		t.Errorf("ParseError at end of input not as expected: %+v", perr)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	fmt.Printf("TestRecovery\n")
+
+	damaged := "junk (;GM[1]FF[4]SZ[19];[orphan]B[dd]%;W[pp](;B[pd]()(;B[dp];W[dq]C[unterminated"
+
+	_, err := LoadSGF(damaged)
+	if err == nil {
+		t.Errorf("Damaged SGF loaded without error in strict mode")
+	}
+
+	root, warnings, err := LoadReaderOptions(strings.NewReader(damaged), LoadOptions{Recover: true})
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if len(warnings) == 0 {
+		t.Errorf("No warnings were given")
+	}
+
+	if root.TreeSize() != 6 {
+		t.Errorf("Recovered tree was not of expected size: %d", root.TreeSize())
+	}
+
+	if root.MainChild().KeyCount() != 1 {
+		t.Errorf("Orphan value was not dropped")
+	}
+
+	comment, _ := root.GetEnd().GetValue("C")
+	if comment != "unterminated" {
+		t.Errorf("Unterminated value was not kept")
+	}
+}
+
+type upper_charset struct{}			// A silly charset for testing: ASCII but all lowercase is stored as uppercase.
+
+func (self upper_charset) Decode(b []byte) (string, error) {
+	return strings.ToLower(string(b)), nil
+}
+
+func (self upper_charset) Encode(s string) ([]byte, error) {
+	return []byte(strings.ToUpper(s)), nil
+}
+
+func TestCharset(t *testing.T) {
+	fmt.Printf("TestCharset\n")
+
+	root, err := Load("test_kifu/latin1.sgf")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	pb, _ := root.GetValue("PB")
+	pw, _ := root.GetValue("PW")
+	ca, _ := root.GetValue("CA")
+
+	if pb != "René" || pw != "Jürgen" || ca != "UTF-8" {
+		t.Errorf("Latin-1 values were not transcoded: %q %q %q", pb, pw, ca)
+	}
+
+	s, err := root.SGFOptions(WriteOptions{Charset: "ISO-8859-1"})
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if strings.Contains(s, "Ren\xe9") == false || strings.Contains(s, "CA[ISO-8859-1]") == false || strings.Contains(s, "UTF-8") {
+		t.Errorf("Re-encoding on save did not work: %q", s)
+	}
+
+	root, _, err = LoadReaderOptions(strings.NewReader("(;CA[upper]PB[FOO BAR];B[dd])"),
+		LoadOptions{Charsets: map[string]Charset{"UPPER": upper_charset{}}})
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	pb, _ = root.GetValue("PB")
+	if pb != "foo bar" {
+		t.Errorf("Custom charset was not used: %q", pb)
+	}
+
+	root, _ = LoadSGF("(;CA[upper]PB[FOO BAR];B[dd])")
+	pb, _ = root.GetValue("PB")
+	if pb != "FOO BAR" {
+		t.Errorf("Unknown charset was not left alone: %q", pb)
+	}
+}
+
+func TestLongKeys(t *testing.T) {
+	fmt.Printf("TestLongKeys\n")
+
+	old := "(;Game[1]Size[9]AddBlack[cc][gg]Komi[5.5]Foo[bar];Black[ee]Comment[hi])"
+
+	root, err := LoadSGF(old)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if root.ValueCount("AB") != 2 || root.ValueCount("S") != 1 || root.ValueCount("SZ") != 0 {
+		t.Errorf("Default key handling has changed")
+	}
+
+	decoder := NewDecoderOptions(strings.NewReader(old), LoadOptions{Keys: NORMALISE_KEYS})
+	root, err = decoder.Decode()
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if root.ValueCount("AB") != 2 || root.ValueCount("SZ") != 1 || root.ValueCount("KM") != 1 || root.ValueCount("F") != 1 {
+		t.Errorf("Keys were not normalised")
+	}
+
+	if root.RootBoardSize() != 9 || root.MainChild().ValueCount("C") != 1 {
+		t.Errorf("Keys were not normalised")
+	}
+
+	rewrites := decoder.KeyRewrites()
+	if len(rewrites) != 7 || rewrites["Size"] != "SZ" || rewrites["Foo"] != "F" {
+		t.Errorf("KeyRewrites() not as expected: %v", rewrites)
+	}
+
+	root, _, err = LoadReaderOptions(strings.NewReader(old), LoadOptions{Keys: VERBATIM_KEYS})
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if root.ValueCount("AddBlack") != 2 || root.ValueCount("Foo") != 1 || root.KeyCount() != 5 {
+		t.Errorf("Keys were not kept verbatim")
+	}
+
+	// Lowercase between values doesn't start a new key...
+
+	for _, mode := range []KeyMode{NORMALISE_KEYS, VERBATIM_KEYS} {
+		decoder := NewDecoderOptions(strings.NewReader("(;AB[aa]foo[bb])"), LoadOptions{Keys: mode})
+		root, err := decoder.Decode()
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+		if root.ValueCount("AB") != 2 || root.KeyCount() != 1 || len(decoder.KeyRewrites()) != 0 {
+			t.Errorf("Lowercase between values mishandled: %d AB values, rewrites %v", root.ValueCount("AB"), decoder.KeyRewrites())
+		}
+	}
+}
+
+func TestCollectionReader(t *testing.T) {
+	fmt.Printf("TestCollectionReader\n")
+
+	reader, err := OpenCollection("test_kifu/collection.sgf")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	defer reader.Close()
+
+	var sizes []int
+
+	for i := 0; ; i++ {
+
+		root, err := reader.NextRoot()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Errorf(err.Error())
+			return
+		}
+
+		if root.TreeSize() != 1 {
+			t.Errorf("NextRoot() read more than the root")
+		}
+
+		if i == 1 {
+			root, err = reader.Finish()
+			if err != nil {
+				t.Errorf(err.Error())
+				return
+			}
+		}
+
+		sizes = append(sizes, root.TreeSize())
+	}
+
+	if len(sizes) != 3 || sizes[0] != 1 || sizes[1] != 244 || sizes[2] != 1 {
+		t.Errorf("Sizes not as expected: %v", sizes)
+	}
+
+	reader = NewCollectionReader(strings.NewReader("(;GM[1];B[dd]) (;GM[1]C[a \\) b](;B[pp])(;B[pd])) (;GM[1])"))
+
+	reader.NextRoot()							// Skipped implicitly by Next()
+
+	root, err := reader.Next()
+	if err != nil || root.TreeSize() != 3 {
+		t.Errorf("Next() after NextRoot() did not get the second tree")
+	}
+
+	root, err = reader.NextRoot()
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	root, err = reader.Finish()
+	if err != nil || root.TreeSize() != 1 {
+		t.Errorf("Finish() on a root-only tree failed")
+	}
+
+	_, err = reader.Next()
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+
+	// In recovery mode, the root can be read from inside merged subtrees, which
+	// Skip() must get all the way out of...
+
+	reader = NewCollectionReaderOptions(strings.NewReader("(((;PB[x];B[aa])(;B[bb])))(;PB[y])"), LoadOptions{Recover: true})
+
+	reader.NextRoot()
+
+	root, err = reader.NextRoot()
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	if pb, _ := root.GetValue("PB"); pb != "y" {
+		t.Errorf("Skip() did not reach the end of the tree")
+	}
+
+	// ...and so must Finish(), giving the same tree as Next() would...
+
+	reader = NewCollectionReaderOptions(strings.NewReader("(((;PB[x];B[aa])(;B[bb])))(;PB[y])"), LoadOptions{Recover: true})
+
+	reader.NextRoot()
+
+	root, err = reader.Finish()
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	if root.SGF() != "(;PB[x](;B[aa])(;B[bb]))" {
+		t.Errorf("Finish() gave wrong tree: %s", root.SGF())
+	}
+
+	root, err = reader.Next()
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	if pb, _ := root.GetValue("PB"); pb != "y" {
+		t.Errorf("Finish() did not reach the end of the tree")
+	}
+}
+
+func TestPrettyPrinting(t *testing.T) {
+	fmt.Printf("TestPrettyPrinting\n")
+
+	root, err := Load("test_kifu/2016-03-10a.sgf")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	root.MainChild().AddValue("C", "A comment ] with \\ some\nnewlines   and spaces")
+
+	for _, opts := range []WriteOptions{
+		{NodesPerLine: 1},
+		{NodesPerLine: 10, Indent: "  "},
+		{Indent: "\t", NodesPerLine: 5},
+		{MaxWidth: 40},
+		{MaxWidth: 1, OrderProperties: true},
+	} {
+		s, err := root.SGFOptions(opts)
+		if err != nil {
+			t.Errorf(err.Error())
+			return
+		}
+
+		if strings.Count(s, "\n") < 10 {
+			t.Errorf("Output was not split into lines with %+v", opts)
+		}
+
+		if opts.MaxWidth > 1 {				// Not testing with Indent, since deep nesting can make it impossible.
+			for _, line := range strings.Split(s, "\n") {
+				if len(line) > opts.MaxWidth && strings.Contains(line, "newlines") == false {
+					t.Errorf("Line exceeded MaxWidth: %q", line)
+					break
+				}
+			}
+		}
+
+		if opts.MaxWidth > 0 {
+			for _, line := range strings.Split(s, "\n") {
+				if strings.HasSuffix(line, "(") {
+					t.Errorf("Line ended with a lone (: %q", line)
+					break
+				}
+			}
+		}
+
+		reloaded, err := LoadSGF(s)
+		if err != nil {
+			t.Errorf(err.Error())
+			return
+		}
+
+		if opts.OrderProperties == false && reloaded.SGF() != root.SGF() {
+			t.Errorf("Tree changed after pretty printing with %+v", opts)
+		}
+
+		if reloaded.TreeSize() != root.TreeSize() {
+			t.Errorf("Tree changed after pretty printing with %+v", opts)
+		}
+	}
+
+	node := NewTree(19)
+	node.AddValue("TR", "aa")
+	node.AddValue("C", "foo")
+	node.AddValue("AB", "dd")
+	node.AddValue("PB", "bar")
+
+	s, _ := node.SGFOptions(WriteOptions{OrderProperties: true})
+	if s != "(;GM[1]FF[4]SZ[19]PB[bar]AB[dd]C[foo]TR[aa])" {
+		t.Errorf("Properties not ordered as expected: %s", s)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	fmt.Printf("TestCanonical\n")
+
+	a, _ := LoadSGF("(;GM[1]FF[4]SZ[9]AB[cc][aa:ab]AW[ee]C[hi];B[tt](;W[dd])(;W[]))")
+	b, _ := LoadSGF("(;FF[4]C[hi]AW[ee]AB[ab][cc][aa]SZ[9]GM[1];B[](;W[dd])(;W[tt]))")
+	c, _ := LoadSGF("(;FF[4]C[hi]AW[ee]AB[ab][cc][aa]SZ[9]GM[1];B[](;W[])(;W[dd]))")		// Variation order matters.
+
+	sa, _ := a.SGFOptions(WriteOptions{Canonical: true, Indent: "  "})
+
+	if sa != "(;AB[aa][ab][cc]AW[ee]C[hi]FF[4]GM[1]SZ[9];B[](;W[dd])(;W[]))" {
+		t.Errorf("Canonical output not as expected: %s", sa)
+	}
+
+	if a.CanonicalHash() != b.CanonicalHash() {
+		t.Errorf("Equivalent trees had different hashes")
+	}
+
+	if a.CanonicalHash() == c.CanonicalHash() {
+		t.Errorf("Different trees had the same hash")
+	}
+
+	if a.GetEnd().CanonicalHash() != a.CanonicalHash() {
+		t.Errorf("CanonicalHash() was not of the whole tree")
+	}
+
+	var nil_node *Node
+	if nil_node.CanonicalHash() != "" {
+		t.Errorf("CanonicalHash() of nil node was not empty")
+	}
+
+	// CA goes in its sorted place when a charset is given...
+
+	sa, _ = a.SGFOptions(WriteOptions{Canonical: true, Charset: "ISO-8859-1"})
+	if sa != "(;AB[aa][ab][cc]AW[ee]C[hi]CA[ISO-8859-1]FF[4]GM[1]SZ[9];B[](;W[dd])(;W[]))" {
+		t.Errorf("Canonical output with charset not as expected: %s", sa)
+	}
+
+	// Malformed moves are not turned into passes...
+
+	d, _ := LoadSGF("(;SZ[9];B[zz])")
+	e, _ := LoadSGF("(;SZ[9];B[])")
+	if d.CanonicalHash() == e.CanonicalHash() {
+		t.Errorf("Malformed move had the same hash as a pass")
+	}
+}
+
+func TestPointCompression(t *testing.T) {
+	fmt.Printf("TestPointCompression\n")
+
+	root := NewTree(19)
+	for x := 2; x <= 6; x++ {
+		for y := 3; y <= 5; y++ {
+			root.AddValue("AB", Point(x, y))
+		}
+	}
+	root.AddValue("AB", "pp")
+	root.AddValue("AB", "pq")
+	root.AddValue("TR", "aa")
+
+	s, _ := root.SGFOptions(WriteOptions{CompressPoints: true})
+	if s != "(;GM[1]FF[4]SZ[19]AB[cd:gf][pp:pq]TR[aa])" {
+		t.Errorf("Compressed output not as expected: %s", s)
+	}
+
+	reloaded, _ := LoadSGF(s)
+	if reloaded.Board().Equals(root.Board()) == false {
+		t.Errorf("Board changed after compression")
+	}
+
+	root, _, err := LoadReaderOptions(strings.NewReader(s), LoadOptions{ExpandPoints: true})
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if root.ValueCount("AB") != 17 || root.ValueCount("TR") != 1 {
+		t.Errorf("Rectangles were not expanded on load")
+	}
+
+	if len(CompressPoints([]string{"aa", "ba", "ab", "bb", "cb", "zz"}, 19)) != 3 {
+		t.Errorf("CompressPoints() gave an unexpected result")
+	}
+}
+
+type failing_writer struct {
+	remaining		int
+}
+
+func (self *failing_writer) Write(p []byte) (int, error) {
+	if len(p) > self.remaining {
+		n := self.remaining
+		self.remaining = 0
+		return n, fmt.Errorf("failing_writer: out of space")
+	}
+	self.remaining -= len(p)
+	return len(p), nil
+}
+
+func TestSaving(t *testing.T) {
+	fmt.Printf("TestSaving\n")
+
+	root, err := Load("test_kifu/2016-03-10a.sgf")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	err = SaveCollectionTo(&failing_writer{remaining: 1000}, []*Node{root})
+	if err == nil {
+		t.Errorf("SaveCollectionTo() did not return the writer's error")
+	}
+
+	var buf strings.Builder
+	err = SaveCollectionTo(&buf, []*Node{root, root.GetEnd()})
+	if err != nil || buf.String() != root.SGF() + root.SGF() {
+		t.Errorf("SaveCollectionTo() output not as expected")
+	}
+
+	dir, err := os.MkdirTemp("", "sgf_test")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	filename := dir + "/foo.sgf"
+
+	err = root.Save(filename)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	original := root.SGF()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	root.MainChild().SetValue("C", "This change should never be saved.")
+
+	err = root.SaveOptions(filename, WriteOptions{Context: ctx})
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	reloaded, err := Load(filename)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if reloaded.SGF() != original {
+		t.Errorf("Original file was damaged by failed save")
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Temporary file was left behind")
+	}
+
+	// Saving via a symlink replaces the target, not the link...
+
+	link := dir + "/link.sgf"
+	if os.Symlink("foo.sgf", link) == nil {
+		root.MainChild().DeleteKey("C")
+		root.MainChild().SetValue("C", "Saved via link.")
+		err = root.Save(link)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		if info, err := os.Lstat(link); err != nil || info.Mode() & os.ModeSymlink == 0 {
+			t.Errorf("Symlink was replaced")
+		}
+		if reloaded, _ := Load(filename); reloaded == nil || reloaded.SGF() != root.SGF() {
+			t.Errorf("Symlink target was not updated")
+		}
+	}
+}
+
+func TestGibMetadata(t *testing.T) {
+	fmt.Printf("TestGibMetadata\n")
+
+	expect := func(node *Node, key, val string) {
+		if got, _ := node.GetValue(key); got != val {
+			t.Errorf("Wrong %s: got %q, expected %q", key, got, val)
+		}
+	}
+
+	root, err := Load("test_kifu/3handicap.gib")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	expect(root, "PB", "Silver Star")
+	expect(root, "BR", "8k")
+	expect(root, "PW", "jimmy")
+	expect(root, "WR", "5k")
+	expect(root, "PC", "Tygem Baduk")
+	expect(root, "TM", "60000")
+	expect(root, "DT", "2017-03-16")
+	expect(root, "RE", "B+4")
+
+	root, err = Load("test_kifu/korean.gib")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	expect(root, "PB", "박정환")
+	expect(root, "BR", "9d")
+	expect(root, "WR", "9d")
+	expect(root, "EV", "제1기 타이젬배")
+	expect(root, "AN", "김해설")
+	expect(root, "GC", "결승 제1국")
+	expect(root, "RU", "Korean")
+	expect(root, "TM", "1800")
+	expect(root, "OT", "3x30 byo-yomi")
+	expect(root, "KM", "6.5")
+	expect(root, "RE", "B+R")
+
+	if root.TreeSize() != 7 || root.RootBoardSize() != 19 {
+		t.Errorf("Wrong tree")
+	}
+
+	// Korean names in EUC-KR, given a charset for it...
+
+	euc_kr := "\\HS\n\\[GAMEBLACKNAME=\xc7\xd1 (9D)\\]\n\\HE\n\\GS\nINI 0 1 0 &4\nSTO 0 2 1 3 3\n\\GE\n"
+	opts := LoadOptions{Charsets: map[string]Charset{"EUC-KR": stub_charset{"\xc7\xd1", "\ud55c"}}}
+
+	root, err = LoadGIBOptions(euc_kr, opts)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	expect(root, "PB", "\ud55c")
+	expect(root, "BR", "9d")
+	expect(root, "CA", "UTF-8")
+
+	if _, err = LoadGIBOptions(strings.Replace(euc_kr, "\xd1", "", 1), opts); err == nil {
+		t.Errorf("LoadGIBOptions() accepted undecodable input")
+	}
+
+	opts.Recover = true
+	if _, err = LoadGIBOptions(strings.Replace(euc_kr, "\xd1", "", 1), opts); err != nil {
+		t.Errorf("LoadGIBOptions() with Recover failed: %v", err)
+	}
+
+	root, err = Load("test_kifu/free_handicap.gib")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	expect(root, "SZ", "13")
+	expect(root, "HA", "2")
+	expect(root, "BR", "5k")
+	expect(root, "DT", "2021-11-05")
+	expect(root, "RU", "Chinese")
+	expect(root, "TM", "600")
+	expect(root, "KM", "0.5")			// From GAMEINFOMAIN, as there's no GAMETAG.
+	expect(root, "RE", "W+")
+
+	stones := root.AllValues("AB")
+	if len(stones) != 2 || stones[0] != "dd" || stones[1] != "jj" {
+		t.Errorf("Free handicap placement not respected: %v", stones)
+	}
+
+	if root.TreeSize() != 4 {
+		t.Errorf("Wrong tree size")
+	}
+
+	mv, _ := root.MainChild().GetValue("W")
+	if mv != "jd" {
+		t.Errorf("First move should have been White's")
+	}
+}
+
+func TestGibNgfExport(t *testing.T) {
+	fmt.Printf("TestGibNgfExport\n")
+
+	for _, filename := range []string{"test_kifu/3handicap.gib", "test_kifu/korean.gib", "test_kifu/free_handicap.gib"} {
+
+		root, err := Load(filename)
+		if err != nil {
+			t.Errorf(err.Error())
+			return
+		}
+
+		gib, err := root.GetEnd().GIB()
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+
+		reloaded, err := LoadGIB(gib)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+
+		// Free handicap placement is written as an even game, with Black's stones
+		// as moves, so only the position survives...
+
+		if root.ValueCount("AB") > 0 && is_tygem_handicap(root.AllValues("AB"), root.RootBoardSize()) == false {
+			if reloaded.RootHandicap() != 0 || reloaded.ValueCount("AB") != 0 {
+				t.Errorf("GIB of %s kept a handicap the Tygem client would place differently", filename)
+			}
+			if reloaded.GetEnd().Board().Equals(root.GetEnd().Board()) == false {
+				t.Errorf("GIB of %s reached a different position", filename)
+			}
+			continue
+		}
+
+		if reloaded.SGF() != root.SGF() {
+			t.Errorf("GIB round trip of %s failed", filename)
+		}
+	}
+
+	root, err := Load("test_kifu/3handicap.ngf")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	ngf, err := root.NGF()
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	reloaded, err := LoadNGF(ngf)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if reloaded.SGF() != root.SGF() {
+		t.Errorf("NGF round trip failed")
+	}
+
+	// Komi: NGF adds a half point to whole numbers when loading, so whole number
+	// komi can't survive...
+
+	for _, item := range []struct{km string; back float64; ok bool}{
+		{"6.5", 6.5, true}, {"-3.5", -3.5, true}, {"2.3", 2.3, true}, {"0", 0.5, true}, {"7", 7.5, true}, {"", 0.5, true}, {"0.75", 0, false},
+	} {
+		root, _ := LoadSGF("(;SZ[19];B[pd];W[dd])")
+		if item.km != "" {
+			root.SetValue("KM", item.km)
+		}
+		ngf, err := root.NGF()
+		if item.ok == false {
+			if err == nil {
+				t.Errorf("NGF() accepted KM[%s]", item.km)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NGF() with KM[%s]: %v", item.km, err)
+			continue
+		}
+		reloaded, _ := LoadNGF(ngf)
+		if reloaded.RootKomi() != item.back {
+			t.Errorf("KM[%s] came back as %v", item.km, reloaded.RootKomi())
+		}
+	}
+
+	// A GIB handicap game with no komi converts...
+
+	root, err = Load("test_kifu/3handicap.gib")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	ngf, err = root.GetEnd().NGF()
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	reloaded, err = LoadNGF(ngf)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if reloaded.RootHandicap() != 3 || reloaded.GetEnd().Board().Equals(root.GetEnd().Board()) == false {
+		t.Errorf("Conversion of 3handicap.gib to NGF failed")
+	}
+
+	// Only the line through the node is exported, without passes...
+
+	root, err = LoadSGF("(;SZ[19]KM[6.5]RE[W+R];B[pd]C[Comment];W[dd](;B[pp];W[];B[dp])(;B[qq]))")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "sgf_test")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for _, filename := range []string{dir + "/foo.gib", dir + "/foo.ngf"} {
+
+		if strings.HasSuffix(filename, ".gib") {
+			err = root.MainChild().SaveGIB(filename)
+		} else {
+			err = root.MainChild().SaveNGF(filename)
+		}
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+
+		reloaded, err := Load(filename)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+
+		var moves []string
+		for node := reloaded; node != nil; node = node.MainChild() {
+			for _, key := range []string{"B", "W"} {
+				if val, ok := node.GetValue(key); ok {
+					moves = append(moves, key + val)
+				}
+			}
+		}
+
+		if strings.Join(moves, " ") != "Bpd Wdd Bpp Bdp" {
+			t.Errorf("Wrong moves from %s: %v", filename, moves)
+		}
+
+		if km, _ := reloaded.GetValue("KM"); km != "6.5" {
+			t.Errorf("Wrong komi from %s: %q", filename, km)
+		}
+
+		if re, _ := reloaded.GetValue("RE"); re != "W+R" {
+			t.Errorf("Wrong result from %s: %q", filename, re)
+		}
+	}
+
+	// Things the formats can't represent...
+
+	root.MainChild().AddValue("AW", "cc")
+
+	if _, err := root.GIB(); err == nil {
+		t.Errorf("GIB() accepted mid-game setup")
+	}
+
+	root, _ = LoadSGF("(;SZ[19]HA[2]AB[cc][qq];W[pd])")
+
+	if _, err := root.NGF(); err == nil {
+		t.Errorf("NGF() accepted free handicap placement")
+	}
+}
+
+func TestUgf(t *testing.T) {
+	fmt.Printf("TestUgf\n")
+
+	expect := func(node *Node, key, val string) {
+		if got, _ := node.GetValue(key); got != val {
+			t.Errorf("Wrong %s: got %q, expected %q", key, got, val)
+		}
+	}
+
+	root, err := Load("test_kifu/commentary.ugf")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	expect(root, "SZ", "9")
+	expect(root, "GN", "Honinbo Title Match, Game 3")
+	expect(root, "DT", "2005-05-12")
+	expect(root, "PB", "Foo Bar")
+	expect(root, "BR", "9d")
+	expect(root, "WR", "9p")
+	expect(root, "RU", "Japanese")
+	expect(root, "RE", "W+R")
+	expect(root, "KM", "0.5")
+	expect(root, "HA", "2")
+	expect(root, "GC", "A handicap game")
+	expect(root, "C", "Before the game.")
+
+	if root.ValueCount("AB") != 2 || root.TreeSize() != 5 {
+		t.Errorf("Wrong tree")
+	}
+
+	node := root.MainChild()
+	expect(node, "W", "gc")
+	node = node.MainChild()
+	expect(node, "B", "cg")
+	expect(node, "C", "Black takes the corner.\n\nA second paragraph.")
+	node = node.MainChild()
+	expect(node, "W", "")
+	node = node.MainChild()
+	expect(node, "B", "ee")
+	expect(node, "C", ".Text and a line that looks like a command.")
+
+	ugf, err := node.UGF()
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	reloaded, err := LoadUGF(ugf)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if reloaded.SGF() != root.SGF() {
+		t.Errorf("UGF round trip failed")
+	}
+
+	// Comments on nodes without moves join the previous move's comment...
+
+	root, _ = LoadSGF("(;C[Root];B[dd];C[Empty node](;W[pp]C[Main])(;W[dp]C[Variation]))")
+
+	dir, err := os.MkdirTemp("", "sgf_test")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	err = root.SaveUGF(dir + "/foo.ugi")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	reloaded, err = Load(dir + "/foo.ugi")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if reloaded.SGF() != "(;GM[1]FF[4]SZ[19]C[Root];B[dd]C[Empty node];W[pp]C[Main])" {
+		t.Errorf("Wrong tree from saved UGI: %s", reloaded.SGF())
+	}
+
+	// Comment lines that look like commands, indented or not, survive...
+
+	comment := "Before\n.EndText\n  .EndText\n .Text,3\nAfter"
+
+	root, _ = LoadSGF("(;SZ[9];B[dd])")
+	root.MainChild().SetValue("C", comment)
+
+	ugf, err = root.UGF()
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	reloaded, err = LoadUGF(ugf)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if c, _ := reloaded.MainChild().GetValue("C"); c != comment {
+		t.Errorf("Comment did not survive UGF round trip: %q", c)
+	}
+
+	// Shift_JIS, given a charset for it...
+
+	sjis := "[Header]\nTitle=\x82\xa0\n[Data]\nDD,B1,0\n"
+	opts := LoadOptions{Charsets: map[string]Charset{"SHIFT-JIS": stub_charset{"\x82\xa0", "\u3042"}}}
+
+	root, err = LoadUGFOptions(sjis, opts)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	expect(root, "GN", "\u3042")
+	expect(root, "CA", "UTF-8")
+
+	if _, err = LoadUGFOptions("[Header]\nTitle=\x82\n[Data]\nDD,B1,0\n", opts); err == nil {
+		t.Errorf("LoadUGFOptions() accepted undecodable input")
+	}
+
+	opts.RawCharset = true
+	root, _ = LoadUGFOptions(sjis, opts)
+	expect(root, "GN", "\x82\xa0")
+}
+
+type stub_charset struct {		// Just enough of some charset for testing: one character.
+	encoded			string
+	decoded			string
+}
+
+func (self stub_charset) Decode(b []byte) (string, error) {
+	s := strings.Replace(string(b), self.encoded, self.decoded, -1)
+	if utf8.ValidString(s) == false {
+		return "", fmt.Errorf("stub_charset.Decode(): invalid input")
+	}
+	return s, nil
+}
+
+func (self stub_charset) Encode(s string) ([]byte, error) {
+	return []byte(strings.Replace(s, self.decoded, self.encoded, -1)), nil
+}
+
+func TestDetectFormat(t *testing.T) {
+	fmt.Printf("TestDetectFormat\n")
+
+	dir, err := os.MkdirTemp("", "sgf_test")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for filename, expected := range map[string]Format{
+		"test_kifu/3handicap.gib":		GIB_FORMAT,
+		"test_kifu/korean.gib":			GIB_FORMAT,
+		"test_kifu/3handicap.ngf":		NGF_FORMAT,
+		"test_kifu/commentary.ugf":		UGF_FORMAT,
+		"test_kifu/collection.sgf":		SGF_FORMAT,
+		"test_kifu/unicode.sgf":		SGF_FORMAT,
+	} {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+
+		if got := DetectFormat(data); got != expected {
+			t.Errorf("DetectFormat(%s): got %v, expected %v", filename, got, expected)
+		}
+
+		// Files with the wrong extension should still load...
+
+		misnamed := dir + "/" + strings.Replace(filename, "/", "_", -1) + ".txt"
+		os.WriteFile(misnamed, data, 0644)
+
+		root, err := Load(misnamed)
+		if err != nil {
+			t.Errorf("Load(%s): %v", misnamed, err)
+			continue
+		}
+		original, _ := Load(filename)
+		if root.SGF() != original.SGF() {
+			t.Errorf("Load(%s): wrong tree", misnamed)
+		}
+	}
+
+	for s, expected := range map[string]Format{
+		"\xef\xbb\xbf  ( ;SZ[9])":					SGF_FORMAT,
+		"From: someone\nSubject: game\n\n(;SZ[9])":	SGF_FORMAT,
+		"{\"moves\": []}":							JSON_FORMAT,
+		"{\"nodes\": [[[\"SZ\", \"9\"]]]}":				NODE_JSON_FORMAT,
+		"":											UNKNOWN_FORMAT,
+		"Hello world":								UNKNOWN_FORMAT,
+	} {
+		if got := DetectFormat([]byte(s)); got != expected {
+			t.Errorf("DetectFormat(%q): got %v, expected %v", s, got, expected)
+		}
+	}
+}
+
+func TestOgsJson(t *testing.T) {
+	fmt.Printf("TestOgsJson\n")
+
+	expect := func(node *Node, key, val string) {
+		if got, _ := node.GetValue(key); got != val {
+			t.Errorf("Wrong %s: got %q, expected %q", key, got, val)
+		}
+	}
+
+	root, err := Load("test_kifu/ogs.json")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	expect(root, "SZ", "9")
+	expect(root, "GN", "Friendly Match")
+	expect(root, "PB", "alice")
+	expect(root, "BR", "5k")
+	expect(root, "PW", "bob")
+	expect(root, "WR", "2d")
+	expect(root, "KM", "0.5")
+	expect(root, "RU", "Japanese")
+	expect(root, "RE", "W+R")
+	expect(root, "DT", "2017-07-14")
+	expect(root, "HA", "2")
+	expect(root, "TM", "60")
+	expect(root, "OT", "3x10 byo-yomi")
+
+	if strings.Join(root.AllValues("AB"), " ") != "cg gc" {
+		t.Errorf("Wrong AB: %v", root.AllValues("AB"))
+	}
+
+	// White has 60 seconds; 20 then 55 seconds used, so the 2nd move is in
+	// byo-yomi with 1 period used up...
+
+	node := root.MainChild()
+	expect(node, "W", "gg")
+	expect(node, "WL", "40")
+	node = node.MainChild()
+	expect(node, "B", "cc")
+	expect(node, "BL", "30")
+	node = node.MainChild()
+	expect(node, "W", "ee")
+	expect(node, "WL", "10")
+	expect(node, "OW", "2")
+	node = node.MainChild()
+	expect(node, "B", "")
+	expect(node, "BL", "15")
+
+	if node.MainChild() != nil {
+		t.Errorf("Wrong number of moves")
+	}
+
+	// The whole API response, with the game in "gamedata", is also fine...
+
+	root, err = LoadOGSJSON(`{"players": {"black": {"username": "x"}}, "gamedata": {"komi": 7.5, "moves": [[3, 3, 0]]}}`)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	expect(root, "PB", "x")
+	expect(root, "KM", "7.5")
+	expect(root.MainChild(), "B", "dd")
+
+	if _, err := LoadOGSJSON(`{"moves": [[30, 3]]}`); err == nil {
+		t.Errorf("LoadOGSJSON() accepted an offboard move")
+	}
+
+	if _, err := LoadOGSJSON(`{"foo": 1, "gamedata": {"bar": 2}}`); err == nil {
+		t.Errorf("LoadOGSJSON() accepted JSON with no OGS fields")
+	}
+
+	// Load() must send this library's own JSON to the right place...
+
+	dir, err := os.MkdirTemp("", "sgf_test")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	original, _ := LoadSGF("(;SZ[9]KM[6.5];B[cc](;W[gg])(;W[cg]))")
+	b, _ := json.Marshal(original)
+
+	filename := dir + "/tree.json"
+	os.WriteFile(filename, b, 0644)
+
+	root, err = Load(filename)
+	if err != nil || root.SGF() != original.SGF() {
+		t.Errorf("Load() on node JSON failed: %v", err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	fmt.Printf("TestJSON\n")
+
+	for _, filename := range []string{"test_kifu/2016-03-10a.sgf", "test_kifu/escaped.sgf", "test_kifu/unicode.sgf", "test_kifu/instabranch.sgf"} {
+
+		root, err := Load(filename)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+
+		b, err := json.Marshal(root)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+
+		restored := new(Node)
+		err = json.Unmarshal(b, restored)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+
+		if restored.SGF() != root.SGF() || restored.TreeSize() != root.TreeSize() {
+			t.Errorf("JSON round trip of %s failed", filename)
+		}
+	}
+
+	root, _ := LoadSGF(`(;SZ[9]C[a "quote" and \] bracket];B[cc](;W[gg])(;W[cg]TR[aa][bb]))`)
+
+	b, _ := json.Marshal(root.MainChild())
+	if string(b) != `{"nodes":[[["B","cc"]]],"variations":[{"nodes":[[["W","gg"]]]},{"nodes":[[["W","cg"],["TR","aa","bb"]]]}]}` {
+		t.Errorf("Unexpected JSON: %s", b)
+	}
+
+	var holder struct {
+		Node		*Node		`json:"node"`
+	}
+	b, err := json.Marshal(holder)
+	if err != nil || string(b) != `{"node":null}` {
+		t.Errorf("Nil node: got %s, %v", b, err)
+	}
+	b, err = holder.Node.MarshalJSON()
+	if err != nil || string(b) != "null" {
+		t.Errorf("Nil node: got %s, %v", b, err)
+	}
+
+	// Unmarshalling into a node in a tree replaces its subtree, and the boards
+	// below it must reflect that...
+
+	old_child := root.MainChild().MainChild()
+	old_child.Board()
+
+	err = json.Unmarshal([]byte(`{"nodes":[[["B","ee"]],[["W","dd"]]]}`), root.MainChild())
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if old_child.Parent() != nil {
+		t.Errorf("Old child still has its parent")
+	}
+
+	board := root.GetEnd().Board()
+	if board.Get("ee") != BLACK || board.Get("dd") != WHITE || board.Get("cc") != EMPTY {
+		t.Errorf("Board wrong after UnmarshalJSON")
+	}
+
+	for _, s := range []string{`{"nodes":[[["B"]]]}`, `{"nodes":[[["B","aa"],["B","bb"]]]}`, `{"nodes":[[]],"variations":[null]}`, `{"nodes":[]}`, `[]`} {
+		if json.Unmarshal([]byte(s), new(Node)) == nil {
+			t.Errorf("UnmarshalJSON accepted %s", s)
+		}
+	}
+
+	// Long lines must not run into encoding/json's nesting limit...
+
+	root = NewNode(nil)
+	node := root
+	for i := 0; i < 20000; i++ {
+		node = NewNode(node)
+		node.SetValue("C", fmt.Sprintf("%d", i))
+	}
+	NewNode(node.Parent()).SetValue("C", "Variation")
+
+	b, err = json.Marshal(root)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "sgf_test")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	os.WriteFile(dir + "/long.json", b, 0644)
+
+	restored, err := Load(dir + "/long.json")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if restored.SGF() != root.SGF() || restored.TreeSize() != 20002 {
+		t.Errorf("JSON round trip of long line failed")
+	}
+}
+
+func TestGTP(t *testing.T) {
+	fmt.Printf("TestGTP\n")
+
+	for _, size := range []int{9, 19, 25} {
+		for x := 0; x < size; x++ {
+			for y := 0; y < size; y++ {
+				p := Point(x, y)
+				if ParseGTP(GTP(p, size), size) != p {
+					t.Errorf("GTP() / ParseGTP() mismatch at %s on size %d", p, size)
+				}
+			}
+		}
+	}
+
+	if GTP("dd", 19) != "D16" || GTP("jj", 19) != "K10" || GTP("tt", 19) != "" || GTP("aa", 26) != "" {
+		t.Errorf("GTP() output not as expected")
+	}
+
+	root, _ := LoadSGF("(;SZ[19]KM[6.5]HA[2]AB[dp][pd];W[pp];B[];W[dd]AW[jj](;B[tt])(;B[qq]))")
+
+	commands, err := root.GetEnd().GTPCommands()
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	expected := []string{
+		"boardsize 19",
+		"clear_board",
+		"komi 6.5",
+		"set_free_handicap D4 Q16",
+		"play w Q4",
+		"play b pass",
+		"play w K10",
+		"play w D16",
+		"play b pass",
+	}
+
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected commands: %q", commands)
+	}
+
+	root.MainChild().SetValue("AE", "pp")
+
+	if _, err := root.GetEnd().GTPCommands(); err == nil {
+		t.Errorf("GTPCommands() accepted AE")
+	}
+}
+
+func TestSVG(t *testing.T) {
+	fmt.Printf("TestSVG\n")
+
+	root, _ := LoadSGF("(;SZ[9]AB[ba][ab][ee]AW[ca][bb];W[aa]TR[ca]CR[ee]SQ[ii]MA[hh]SL[gg:hh]LB[ff:A];B[cc];W[dd];B[ec];W[ce]LB[dd:<42>])")
+
+	well_formed := func(s string) bool {
+		decoder := xml.NewDecoder(strings.NewReader(s))
+		for {
+			_, err := decoder.Token()
+			if err == io.EOF {
+				return true
+			}
+			if err != nil {
+				return false
+			}
+		}
+	}
+
+	node := root.MainChild()			// White has just captured at ba, so there's a ko.
+
+	if node.Board().Ko != "ba" {
+		t.Errorf("Test position has no ko")
+	}
+
+	s := node.SVG(SVGOptions{})
+
+	if well_formed(s) == false {
+		t.Errorf("SVG not well-formed")
+	}
+	if s != node.SVG(SVGOptions{}) {
+		t.Errorf("SVG output not deterministic")
+	}
+
+	for _, expected := range []string{
+		`<polygon points="72,16.8 65.76,27.6 78.24,27.6" fill="none" stroke="black"`,	// TR on a white stone
+		`<circle cx="120" cy="120" r="6.12" fill="none" stroke="white"`,				// CR on a black stone
+		`<circle cx="24" cy="24" r="6" fill="none" stroke="black"`,					// Last move
+		`<rect x="42" y="18" width="12" height="12" fill="none"`,					// Ko
+		`fill-opacity="0.35"`,														// SL
+		`>A</text>`,																// LB
+	} {
+		if strings.Contains(s, expected) == false {
+			t.Errorf("SVG lacks %s", expected)
+		}
+	}
+
+	if strings.Count(s, `r="2.4"`) != 9 {
+		t.Errorf("Wrong number of hoshi")
+	}
+
+	node = root.GetEnd()
+	s = node.SVG(SVGOptions{MoveNumbers: 2, CellSize: 30})
+
+	if well_formed(s) == false {
+		t.Errorf("SVG not well-formed")
+	}
+
+	// Only moves 4 and 5 are numbered, and the LB is on top of move 3's stone...
+
+	for _, expected := range []string{`>4</text>`, `>5</text>`, `>&lt;42&gt;</text>`} {
+		if strings.Contains(s, expected) == false {
+			t.Errorf("SVG lacks %s", expected)
+		}
+	}
+	for _, unexpected := range []string{`>2</text>`, `>3</text>`} {
+		if strings.Contains(s, unexpected) {
+			t.Errorf("SVG has %s", unexpected)
+		}
+	}
+
+	s = node.SVG(SVGOptions{Coordinates: true})
+
+	if strings.Contains(s, `>J</text>`) == false || strings.Contains(s, `>9</text>`) == false || strings.Contains(s, `>I</text>`) {
+		t.Errorf("SVG coordinates not as expected")
+	}
+
+	if well_formed(node.Board().SVG(SVGOptions{Background: "url(#a) & b"})) == false {
+		t.Errorf("SVG not well-formed")
+	}
+}
+
+func TestImages(t *testing.T) {
+	fmt.Printf("TestImages\n")
+
+	root, _ := LoadSGF("(;SZ[9]AB[ba][ab]AW[ca][bb];B[ee];W[aa];B[gg]C[Comment];C[Empty node])")
+
+	board := root.Board()
+	img := board.Image()
+
+	if img.Bounds() != image.Rect(0, 0, 24 * 10, 24 * 10) {
+		t.Errorf("Wrong image bounds %v", img.Bounds())
+	}
+
+	// Points are at 24 + 24n. We look slightly off-centre, to miss the grid
+	// lines and the last move marker...
+
+	colour_at := func(img image.Image, x, y int) color.RGBA {
+		r, g, b, a := img.At(24 + 24 * x + 4, 24 + 24 * y + 4).RGBA()
+		return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+	}
+
+	black := color.RGBA{0, 0, 0, 255}
+	white := color.RGBA{255, 255, 255, 255}
+
+	if colour_at(img, 1, 0) != black || colour_at(img, 2, 0) != white {
+		t.Errorf("Stones not drawn")
+	}
+
+	anim, err := root.GetEnd().AnimatedGIF(0, 3)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if len(anim.Image) != 4 || len(anim.Delay) != 4 {
+		t.Errorf("Wrong number of frames")
+	}
+
+	// Frame 2 is after White's capture at aa, which leaves a ko at ba, and
+	// marks aa as the last move...
+
+	if colour_at(anim.Image[2], 1, 0) == black || colour_at(anim.Image[2], 0, 0) != white {
+		t.Errorf("Capture not shown")
+	}
+
+	if colour_at(anim.Image[3], 6, 6) != black || anim.Image[3].At(24 + 24 * 6, 24 + 24 * 6) == anim.Image[2].At(24 + 24 * 6, 24 + 24 * 6) {
+		t.Errorf("Last move not marked")
+	}
+
+	var buf bytes.Buffer
+
+	err = gif.EncodeAll(&buf, anim)
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	decoded, err := gif.DecodeAll(&buf)
+	if err != nil || len(decoded.Image) != 4 {
+		t.Errorf("GIF did not survive encoding")
+	}
+
+	if _, err := root.AnimatedGIF(2, 4); err == nil {
+		t.Errorf("AnimatedGIF() accepted a bad range")
+	}
+
+	// A move on the root, and a node holding both B and W...
+
+	for _, sgf := range []string{"(;SZ[9]B[cc];W[gg];B[cg])", "(;SZ[9];B[cc]W[gg];B[cg])"} {
+		root, _ := LoadSGF(sgf)
+		anim, err := root.AnimatedGIF(0, 3)
+		if err != nil || len(anim.Image) != 4 {
+			t.Errorf("AnimatedGIF() failed on %s: %v", sgf, err)
+			continue
+		}
+		if colour_at(anim.Image[0], 2, 2) == black || colour_at(anim.Image[1], 2, 2) != black {
+			t.Errorf("Wrong first frames for %s", sgf)
+		}
+		if colour_at(anim.Image[2], 6, 6) != white || colour_at(anim.Image[3], 2, 6) != black {
+			t.Errorf("Wrong later frames for %s", sgf)
+		}
+	}
+}
+
+func TestFigures(t *testing.T) {
+	fmt.Printf("TestFigures\n")
+
+	// A ko at aa / ba: White takes, Black retakes, White retakes, then Black passes.
+
+	root, _ := LoadSGF("(;SZ[9]AB[ba][ab]AW[ca][bb];W[aa];B[cc];W[dd];B[ba];W[ee];B[ff];W[aa];B[])")
+	end := root.GetEnd()
+
+	figs, err := root.Figures(10)
+	if err != nil || len(figs) != 1 {
+		t.Fatalf("Figures(10) gave %d figures, err %v", len(figs), err)
+	}
+
+	fig := figs[0]
+
+	if fig.First != 1 || fig.Last != 8 {
+		t.Errorf("Figure covers %d-%d", fig.First, fig.Last)
+	}
+	if fig.Numbers["aa"] != 1 || fig.Numbers["ff"] != 6 || len(fig.Numbers) != 5 {
+		t.Errorf("Unexpected numbers: %v", fig.Numbers)
+	}
+	if strings.Join(fig.Notes, ", ") != "4 at B9, 7 at 1, 8 pass" {
+		t.Errorf("Unexpected notes: %v", fig.Notes)
+	}
+	if fig.Board.Get("ba") != BLACK || fig.Board.Get("aa") != WHITE {
+		t.Errorf("Figure board does not show the stones as first played")
+	}
+	if strings.Contains(fig.String(), "4 at B9, 7 at 1, 8 pass\n") == false {
+		t.Errorf("Notes missing from String()")
+	}
+
+	s := fig.SVG(SVGOptions{})
+	if strings.Contains(s, "7 at 1,") == false {
+		t.Errorf("Notes missing from SVG()")
+	}
+	if strings.Contains(s, ">6</text>") == false {
+		t.Errorf("Move number missing from SVG()")
+	}
+
+	// Split into figures of 4 moves; called from the end, the line is the same.
+
+	figs, _ = end.Figures(4)
+	if len(figs) != 2 {
+		t.Fatalf("Figures(4) gave %d figures", len(figs))
+	}
+	if figs[1].First != 5 || figs[1].Last != 8 {
+		t.Errorf("Second figure covers %d-%d", figs[1].First, figs[1].Last)
+	}
+	if figs[1].Board.Get("ba") != BLACK || figs[1].Board.Get("cc") != BLACK || len(figs[1].Numbers) != 3 {
+		t.Errorf("Second figure does not start from the actual position")
+	}
+	if figs[1].Numbers["aa"] != 7 || strings.Join(figs[1].Notes, ", ") != "8 pass" {
+		t.Errorf("Second figure: numbers %v, notes %v", figs[1].Numbers, figs[1].Notes)
+	}
+
+	if _, err := root.Figures(0); err == nil {
+		t.Errorf("Figures(0) did not fail")
+	}
+}
+
+func TestHash(t *testing.T) {
+	fmt.Printf("TestHash\n")
+
+	// Transposition: the same stones reached by different move orders...
+
+	root1, _ := LoadSGF("(;SZ[9];B[cc];W[gg];B[cg];W[gc])")
+	root2, _ := LoadSGF("(;SZ[9];B[cg];W[gc];B[cc];W[gg])")
+
+	b1 := root1.GetEnd().Board()
+	b2 := root2.GetEnd().Board()
+
+	if b1.Hash() != b2.Hash() {
+		t.Errorf("Transposed positions have different hashes")
+	}
+
+	// The incremental hash should match a full recalculation, including after captures...
+
+	root, _ := LoadSGF("(;SZ[9]AB[ba][ab]AW[ca][bb];W[aa];B[cc];W[dd];B[ba])")
+
+	for node := root; node != nil; node = node.MainChild() {
+		board := node.Board()
+		h := board.Hash()
+		board.Rehash()
+		if board.Hash() != h {
+			t.Errorf("Incremental hash differs from full recalculation")
+		}
+	}
+
+	// Side to move and ko square are included...
+
+	ko_board := root.MainChild().Board()
+	if ko_board.Ko != "ba" {
+		t.Fatalf("Test position has no ko")
+	}
+
+	no_ko := ko_board.Copy()
+	no_ko.ClearKo()
+	if no_ko.Hash() == ko_board.Hash() || no_ko.StoneHash() != ko_board.StoneHash() {
+		t.Errorf("Ko square not hashed correctly")
+	}
+
+	other_player := no_ko.Copy()
+	other_player.Player = other_player.Player.Opposite()
+	if other_player.Hash() == no_ko.Hash() {
+		t.Errorf("Player to move not hashed")
+	}
+
+	// Removing everything returns to the empty board's hash...
+
+	board := b1.Copy()
+	for _, p := range []string{"cc", "cg"} {
+		board.DestroyGroup(p)
+	}
+	for _, p := range []string{"gg", "gc"} {
+		board.Set(p, EMPTY)
+	}
+	board.Player = BLACK
+	if board.Hash() != NewBoard(9).Hash() {
+		t.Errorf("Emptied board does not hash as empty")
+	}
+	if NewBoard(9).Hash() == NewBoard(19).Hash() {
+		t.Errorf("Board size not hashed")
+	}
+}
+
+func TestSuperko(t *testing.T) {
+	fmt.Printf("TestSuperko\n")
+
+	// The root has White to move. Black takes the ko anyway, both sides pass, and
+	// White retakes, recreating the root's stones but with Black to move.
+
+	root, _ := LoadSGF("(;SZ[5]AB[ab][ba][bc]AW[bb][db][ca][cc]PL[W];B[cb];W[];B[])")
+
+	take := root.MainChild()
+	end := root.GetEnd()
+
+	for _, rules := range []Rules{{Ko: SIMPLE_KO}, {Ko: POSITIONAL_SUPERKO}, {Ko: SITUATIONAL_SUPERKO}} {
+		if legal, _ := take.LegalWithRules("bb", WHITE, rules); legal {
+			t.Errorf("Immediate ko recapture allowed under %v", rules.Ko)
+		}
+		if legal, err := end.LegalWithRules("ee", WHITE, rules); legal == false {
+			t.Errorf("Ordinary move forbidden under %v: %v", rules.Ko, err)
+		}
+	}
+
+	if legal, _ := end.LegalWithRules("bb", WHITE, Rules{Ko: SIMPLE_KO}); legal == false {
+		t.Errorf("Recapture after passes forbidden under simple ko")
+	}
+	if legal, _ := end.LegalWithRules("bb", WHITE, Rules{Ko: POSITIONAL_SUPERKO}); legal {
+		t.Errorf("Repeated position allowed under positional superko")
+	}
+	if legal, _ := end.LegalWithRules("bb", WHITE, Rules{Ko: SITUATIONAL_SUPERKO}); legal == false {
+		t.Errorf("Repeated position with different player to move forbidden under situational superko")
+	}
+
+	// With PL[W] removed from the root, the repetition is situational as well...
+
+	root.DeleteKey("PL")
+
+	if legal, _ := end.LegalWithRules("bb", WHITE, Rules{Ko: SITUATIONAL_SUPERKO}); legal {
+		t.Errorf("Repeated situation allowed under situational superko")
+	}
+
+	// Playing out a game under superko builds each board just once...
+
+	game, err := Load("test_kifu/2016-03-10a.sgf")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	expected := game.GetEnd().Board()
+
+	node, _ := LoadSGF("(;SZ[19]RU[Chinese])")
+	total_board_updates = 0
+
+	line := game.GetEnd().GetLine()
+
+	for _, move := range line[1:] {
+		mv, ok := move.GetValue("B")
+		if ok == false {
+			mv, _ = move.GetValue("W")
+		}
+		if node, err = node.Play(mv); err != nil {
+			t.Errorf(err.Error())
+			return
+		}
+		if err = node.Validate(); err != nil {
+			t.Errorf(err.Error())
+			return
+		}
+	}
+
+	if node.Board().Equals(expected) == false {
+		t.Errorf("Replayed game did not reach the same position")
+	}
+
+	if total_board_updates != len(line) {			// One per node, including the root.
+		t.Errorf("total_board_updates not as expected: %d", total_board_updates)
+	}
+}
+
+func TestRules(t *testing.T) {
+	fmt.Printf("TestRules\n")
+
+	for _, item := range []struct{ru string; name string; ok bool}{
+		{"Japanese", "Japanese", true},
+		{"chinese", "Chinese", true},
+		{"AGA", "AGA", true},
+		{"New Zealand", "NZ", true},
+		{"tromp-taylor", "Tromp-Taylor", true},
+		{"중국룰", "Chinese", true},
+		{"Ing", "Japanese", false},
+		{"", "Japanese", false},
+	} {
+		rules, ok := ParseRules(item.ru)
+		if rules.Name != item.name || ok != item.ok {
+			t.Errorf("ParseRules(%q) gave %q, %v", item.ru, rules.Name, ok)
+		}
+	}
+
+	if ChineseRules.HandicapCompensation(4) != 4 || AGARules.HandicapCompensation(4) != 3 || JapaneseRules.HandicapCompensation(4) != 0 {
+		t.Errorf("HandicapCompensation() wrong")
+	}
+
+	// Suicide...
+
+	board := NewBoard(5)
+	board.AddStone("ab", BLACK)
+	board.AddStone("ba", BLACK)
+
+	if legal, _ := board.LegalColour("aa", WHITE); legal {
+		t.Errorf("Suicide allowed under default rules")
+	}
+
+	board.Rules = NZRules
+	if err := board.PlayColour("aa", WHITE); err != nil {
+		t.Errorf("Suicide forbidden under NZ rules: %v", err)
+	}
+	if board.Get("aa") != EMPTY || board.CapturesBy[BLACK] != 1 {
+		t.Errorf("Suicide not performed correctly")
+	}
+
+	// Pass stones...
+
+	board.Rules = AGARules
+	board.Player = BLACK
+	board.Pass()
+	if board.CapturesBy[WHITE] != 1 {
+		t.Errorf("AGA pass did not give a prisoner")
+	}
+
+	root, _ := LoadSGF("(;SZ[5]RU[AGA];B[cc];W[])")
+	if root.GetEnd().Board().CapturesBy[BLACK] != 1 {
+		t.Errorf("AGA pass in SGF did not give a prisoner")
+	}
+	root.SetValue("RU", "Japanese")
+	if root.GetEnd().Board().CapturesBy[BLACK] != 0 {
+		t.Errorf("Changing RU did not update the cached board")
+	}
+
+	// Superko, via Node.Play and Node.Validate (see TestSuperko for the position)...
+
+	root, _ = LoadSGF("(;SZ[5]RU[Chinese]AB[ab][ba][bc]AW[bb][db][ca][cc];B[cb];W[];B[])")
+	end := root.GetEnd()
+
+	if end.Board().Rules.Name != "Chinese" {
+		t.Errorf("Board did not get rules from RU")
+	}
+	if node, err := end.Play("bb"); err == nil || node != end {
+		t.Errorf("Play() allowed a superko violation")
+	}
+
+	retake := NewNode(end)
+	retake.SetValue("W", "bb")
+	if retake.Validate() == nil {
+		t.Errorf("Validate() accepted a superko violation")
+	}
+
+	root.SetValue("RU", "Japanese")
+	if retake.Validate() != nil {
+		t.Errorf("Validate() rejected a legal Japanese move")
+	}
+	if node, err := end.Play("bb"); err != nil || node != retake {
+		t.Errorf("Play() rejected a legal Japanese move")
+	}
+}
+
+func TestScore(t *testing.T) {
+	fmt.Printf("TestScore\n")
+
+	// Walls on the b and d lines, dame on the c line, and a dead white stone at ac.
+
+	root, _ := LoadSGF("(;SZ[5]KM[6.5]AB[ba][bb][bc][bd][be]AW[da][db][dc][dd][de][ac])")
+	board := root.Board()
+
+	score := board.Score(JapaneseRules, 6.5)
+	if score.Territory[BLACK] != 0 || score.Territory[WHITE] != 5 {
+		t.Errorf("Without dead stones, got territory %v", score.Territory)
+	}
+
+	score = board.Score(JapaneseRules, 6.5, "ac")
+	if score.Territory[BLACK] != 5 || score.Prisoners[BLACK] != 1 || score.Stones[WHITE] != 5 {
+		t.Errorf("Japanese: got territory %v, prisoners %v, stones %v", score.Territory, score.Prisoners, score.Stones)
+	}
+	if score.Margin != -5.5 || score.Result() != "W+5.5" {
+		t.Errorf("Japanese: got %v", score)
+	}
+
+	score = board.Score(ChineseRules, 6.5, "ac")
+	if score.Total[BLACK] != 10 || score.Total[WHITE] != 16.5 || score.Result() != "W+6.5" {
+		t.Errorf("Chinese: got %v", score)
+	}
+
+	if board.Score(ChineseRules, 0, "ac").Result() != "0" {
+		t.Errorf("Draw not reported as 0")
+	}
+	if board.Get("ac") != WHITE {
+		t.Errorf("Score() changed the board")
+	}
+
+	// From TB / TW markup, with rules, komi and handicap bonus from the root...
+
+	root.SetValue("RU", "Chinese")
+	root.SetValue("HA", "2")
+	root.SetValue("TB", "aa:ae")
+	root.SetValue("TW", "ea:ee")
+
+	score = root.Score()
+	if score.Prisoners[BLACK] != 1 || score.HandicapBonus != 2 || score.Result() != "W+8.5" {
+		t.Errorf("Node.Score(): got %v, prisoners %v", score, score.Prisoners)
+	}
+
+	root.SetResult(score)
+	if re, _ := root.GetValue("RE"); re != "W+8.5" {
+		t.Errorf("SetResult() wrote RE %q", re)
+	}
+}
+
+func TestEstimateDead(t *testing.T) {
+	fmt.Printf("TestEstimateDead\n")
+
+	// Walls on the d and e lines. White has a dead stone at bb; Black has dead stones at gg and hc-hd.
+
+	root, _ := LoadSGF("(;SZ[9]KM[6.5]AB[da:di][gg][hc][hd]AW[ea:ei][bb])")
+
+	dead := root.Board().EstimateDead()
+
+	var got []string
+	for _, dg := range dead {
+		got = append(got, fmt.Sprintf("%v %v %v", dg.Colour.Upper(), dg.Stones, dg.Certain))
+	}
+
+	expected := []string{"B [gg] false", "W [bb] false", "B [hc hd] false"}
+	if strings.Join(got, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("EstimateDead() gave %v, expected %v", got, expected)
+	}
+
+	// MarkTerritory() feeds Node.Score()...
+
+	root.MarkTerritory()
+
+	if tb := point_values(root, "TB", 9); len(tb) != 27 {
+		t.Errorf("MarkTerritory() gave %d TB points", len(tb))
+	}
+	if tw := point_values(root, "TW", 9); len(tw) != 36 {
+		t.Errorf("MarkTerritory() gave %d TW points", len(tw))
+	}
+
+	score := root.Score()
+	if score.Prisoners[BLACK] != 1 || score.Prisoners[WHITE] != 3 || score.Result() != "W+17.5" {
+		t.Errorf("Score after MarkTerritory(): got %v", score)
+	}
+
+	// A black stone inside an unconditionally alive white ring, with no room for an eye...
+
+	root, _ = LoadSGF("(;SZ[5]AW[ba:ea][ab:ae][eb:ee][be:de]AB[cc])")
+
+	dead = root.Board().EstimateDead()
+	if len(dead) != 1 || dead[0].Colour != BLACK || dead[0].Stones[0] != "cc" || dead[0].Certain == false {
+		t.Errorf("Benson case: got %d dead groups", len(dead))
+	}
+
+	// Nothing is dead on an empty board, or with two living groups...
+
+	if len(NewBoard(9).EstimateDead()) != 0 {
+		t.Errorf("Dead stones found on empty board")
+	}
+
+	root, _ = LoadSGF("(;SZ[9]AB[da:di]AW[ea:ei])")
+	if len(root.Board().EstimateDead()) != 0 {
+		t.Errorf("Dead stones found between two walls")
+	}
+}
@@ -17,9 +17,12 @@ type Board struct {
 	Size				int
 	Player				Colour
 	Ko					string
+	Rules				Rules				// Affects Play, Legal and Pass, see Rules.
 
 	State				[][]Colour
 	CapturesBy			map[Colour]int
+
+	stone_hash			uint64				// Zobrist hash of State only, see Hash().
 }
 
 // NewBoard returns an empty board of specified size.
@@ -76,6 +79,8 @@ func (self *Board) Copy() *Board {
 	ret.Size = self.Size
 	ret.Player = self.Player
 	ret.Ko = self.Ko
+	ret.Rules = self.Rules
+	ret.stone_hash = self.stone_hash
 
 	// State...
 
@@ -3,7 +3,7 @@ package sgf
 // Note: boards are created only as needed, and some SGF manipulation
 // can be done creating no boards whatsoever.
 
-var mutors = []string{"B", "W", "AB", "AW", "AE", "PL", "SZ"}
+var mutors = []string{"B", "W", "AB", "AW", "AE", "PL", "SZ", "RU"}		// RU since boards carry the rules.
 
 var total_board_updates int			// For debugging.
 
@@ -67,6 +67,7 @@ func (self *Node) Board() *Board {
 		if work == nil {
 			if initial == nil {
 				work = NewBoard(node.RootBoardSize())
+				work.Rules = node.Rules()
 			} else {
 				work = initial.Copy()		// MUST COPY
 			}
@@ -9,6 +9,7 @@ func (self *Board) Set(p string, colour Colour) {
 	if onboard == false {
 		return
 	}
+	self.stone_hash ^= zobrist_stone(self.State[x][y], x, y) ^ zobrist_stone(colour, x, y)
 	self.State[x][y] = colour
 }
 
@@ -57,6 +58,9 @@ func (self *Board) ForceStone(p string, colour Colour) {
 	self.ClearKo()
 
 	if ValidPoint(p, self.Size) == false {		// Consider this a pass
+		if self.Rules.PassStones {
+			self.CapturesBy[colour.Opposite()]++
+		}
 		self.Player = colour.Opposite()
 		return
 	}
@@ -101,6 +105,9 @@ func (self *Board) ForceStone(p string, colour Colour) {
 // intelligently. If successful, the board is changed. If the move is illegal,
 // returns an error.
 //
+// The board's Rules decide whether suicide is allowed. A board has no history,
+// so superko cannot be checked here; see Node.LegalWithRules for that.
+//
 // As a reminder, editing a board has no effect on the node in an SGF tree from
 // which it was created (if any).
 func (self *Board) Play(p string) error {
@@ -118,9 +125,13 @@ func (self *Board) PlayColour(p string, colour Colour) error {
 	return nil
 }
 
-// Pass swaps the identity of the next player, and clears any ko.
+// Pass swaps the identity of the next player, and clears any ko. If the board's
+// rules use pass stones, the opponent is credited with a prisoner.
 func (self *Board) Pass() {
 	self.ClearKo()
+	if self.Rules.PassStones {
+		self.CapturesBy[self.Player.Opposite()]++
+	}
 	self.Player = self.Player.Opposite()
 }
 
@@ -0,0 +1,95 @@
+package sgf
+
+// Zobrist hashing. Each board keeps the hash of its stones up to date as they
+// are set and removed; the side to move and ko square are public fields which
+// callers may set directly, so their keys are only mixed in by Hash() itself,
+// which is still just a couple of XORs.
+
+const zobrist_max_size = 52
+
+var zobrist_stones [2][zobrist_max_size][zobrist_max_size]uint64		// [colour - 1][x][y]
+var zobrist_ko [zobrist_max_size][zobrist_max_size]uint64
+var zobrist_size [zobrist_max_size + 1]uint64
+var zobrist_white_to_move uint64
+
+func init() {
+
+	// The keys are generated with SplitMix64 from a fixed seed, so hashes are the
+	// same on every run and can be stored.
+
+	state := uint64(0x5a6f627269737421)
+
+	next := func() uint64 {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		return z ^ (z >> 31)
+	}
+
+	for c := 0; c < 2; c++ {
+		for x := 0; x < zobrist_max_size; x++ {
+			for y := 0; y < zobrist_max_size; y++ {
+				zobrist_stones[c][x][y] = next()
+			}
+		}
+	}
+
+	for x := 0; x < zobrist_max_size; x++ {
+		for y := 0; y < zobrist_max_size; y++ {
+			zobrist_ko[x][y] = next()
+		}
+	}
+
+	for sz := 0; sz <= zobrist_max_size; sz++ {
+		zobrist_size[sz] = next()
+	}
+
+	zobrist_white_to_move = next()
+}
+
+// Hash returns a 64-bit Zobrist hash of the position: the board size, the
+// stones, the player to move, and the ko square (if any). Captures are not
+// included. Boards which are Equals() apart from captures always have the same
+// hash; different positions almost certainly have different hashes.
+//
+// The hash is maintained as the board is edited via its methods. Writing to
+// the State field directly leaves it stale, which can be fixed with Rehash().
+func (self *Board) Hash() uint64 {
+
+	h := self.stone_hash ^ zobrist_size[self.Size]
+
+	if self.Player == WHITE {
+		h ^= zobrist_white_to_move
+	}
+
+	if x, y, onboard := ParsePoint(self.Ko, self.Size); onboard {
+		h ^= zobrist_ko[x][y]
+	}
+
+	return h
+}
+
+// StoneHash is like Hash, but considers only the board size and the stones, as
+// is needed for positional superko.
+func (self *Board) StoneHash() uint64 {
+	return self.stone_hash ^ zobrist_size[self.Size]
+}
+
+// Rehash recalculates the hash from scratch. It is only needed if the State
+// field has been written to directly.
+func (self *Board) Rehash() {
+	self.stone_hash = 0
+	for x := 0; x < self.Size; x++ {
+		for y := 0; y < self.Size; y++ {
+			self.stone_hash ^= zobrist_stone(self.State[x][y], x, y)
+		}
+	}
+}
+
+func zobrist_stone(colour Colour, x, y int) uint64 {
+	if colour == BLACK || colour == WHITE {
+		return zobrist_stones[colour - 1][x][y]
+	}
+	return 0
+}
@@ -127,7 +127,8 @@ func (self *Board) Singleton(p string) bool {
 
 // Legal returns true if a play at point p would be legal. The argument should
 // be an SGF coordinate, e.g. "dd". The colour is determined intelligently. The
-// board is not changed. If false, the reason is given in the error.
+// board is not changed. If false, the reason is given in the error. Suicide is
+// legal only if the board's Rules allow it.
 func (self *Board) Legal(p string) (bool, error) {
 	return self.LegalColour(p, self.Player)
 }
@@ -190,7 +191,7 @@ func (self *Board) LegalColour(p string, colour Colour) (bool, error) {
 			}
 		}
 
-		if allowed == false {
+		if allowed == false && self.Rules.Suicide == false {
 			return false, fmt.Errorf("suicide at %q (%v,%v) forbidden", p, x, y)
 		}
 	}
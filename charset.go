@@ -0,0 +1,248 @@
+package sgf
+
+// Character set handling, driven by the root CA property.
+//
+// The parser itself is byte-based; values are transcoded once the tree is
+// built. Note that some multi-byte encodings (e.g. Shift_JIS, Big5) can have
+// the bytes ] or \ as the second byte of a character; such files only load
+// correctly if the program that wrote them escaped those bytes.
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Charset converts text between some character set and UTF-8. Only UTF-8,
+// US-ASCII and ISO-8859-1 are built in; others (e.g. GB2312, Shift_JIS, EUC-KR,
+// Big5) can be supplied by the caller with RegisterCharset or LoadOptions.
+type Charset interface {
+	Decode(b []byte) (string, error)		// To UTF-8.
+	Encode(s string) ([]byte, error)		// From UTF-8.
+}
+
+var charsets = map[string]Charset{
+	"UTF8":			utf8_charset{},
+	"ASCII":		utf8_charset{},			// Fine since ASCII is a subset.
+	"USASCII":		utf8_charset{},
+	"ISO88591":		latin1_charset{},
+	"LATIN1":		latin1_charset{},
+}
+
+// RegisterCharset makes a character set available to the loader and writer
+// under the given name, as it would appear in a CA property. Names are matched
+// case-insensitively, ignoring hyphens, underscores and spaces, so "Shift_JIS"
+// and "SHIFT-JIS" are the same. RegisterCharset is not safe to call while files
+// are being loaded or saved in other goroutines.
+func RegisterCharset(name string, cs Charset) {
+	charsets[charset_key(name)] = cs
+}
+
+// NewSingleByteCharset returns a Charset for an ASCII-compatible single-byte
+// character set (e.g. ISO-8859-5 or Windows-1251), given the runes that bytes
+// 128 to 255 represent. Bytes mapped to utf8.RuneError are invalid.
+func NewSingleByteCharset(table [128]rune) Charset {
+	ret := &single_byte_charset{table: table, reverse: make(map[rune]byte)}
+	for i, r := range table {
+		if r != utf8.RuneError {
+			ret.reverse[r] = byte(i + 128)
+		}
+	}
+	return ret
+}
+
+func charset_key(name string) string {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	name = strings.NewReplacer("-", "", "_", "", " ", "").Replace(name)
+	return name
+}
+
+func lookup_charset(name string, extra map[string]Charset) (Charset, bool) {
+	if cs, ok := find_charset(extra, name); ok {
+		return cs, true
+	}
+	return find_charset(charsets, name)
+}
+
+func find_charset(m map[string]Charset, name string) (Charset, bool) {
+	for k, cs := range m {
+		if charset_key(k) == charset_key(name) {
+			return cs, true
+		}
+	}
+	return nil, false
+}
+
+// transcode_nodes converts every value in the nodes to UTF-8, according to the
+// charset named, which would have come from the CA property of the tree's root.
+// Nothing is done if the charset is unknown or is UTF-8, in which case changed
+// is false. If lenient, values that fail to decode are left as they were, and
+// merely counted.
+func transcode_nodes(nodes []*Node, ca string, extra map[string]Charset, lenient bool) (failures int, changed bool, err error) {
+
+	cs, ok := transcoding_charset(ca, extra)
+	if ok == false {
+		return 0, false, nil
+	}
+
+	// We adjust the props directly, which is safe since the tree is fresh (no
+	// board caches) and board-altering values are ASCII anyway.
+
+	for _, node := range nodes {
+		for _, slice := range node.props {						// Values only; keys are always ASCII.
+			for j := 1; j < len(slice); j++ {
+				s, err := cs.Decode([]byte(slice[j]))
+				if err != nil {
+					if lenient == false {
+						return 0, false, fmt.Errorf("transcode_nodes(): CA[%s]: %v", ca, err)
+					}
+					failures++
+					continue
+				}
+				slice[j] = s
+			}
+		}
+	}
+
+	return failures, true, nil
+}
+
+// transcoding_charset returns the charset named by a CA value, if it is known
+// and is not UTF-8, i.e. if values need converting.
+func transcoding_charset(ca string, extra map[string]Charset) (Charset, bool) {
+
+	if ca == "" {
+		return nil, false
+	}
+
+	cs, ok := lookup_charset(ca, extra)
+	if ok == false {
+		return nil, false
+	}
+
+	if _, is_utf8 := cs.(utf8_charset); is_utf8 {
+		return nil, false
+	}
+
+	return cs, true
+}
+
+// load_import runs the loader for some other file format on the text, after
+// converting it to UTF-8 if it is not already valid UTF-8 (and opts.RawCharset
+// is not set). The named charsets are tried in order, first those supplied in
+// opts.Charsets, then registered ones; the first to decode the text is used, and
+// the root is given CA[UTF-8]. If every one known fails, an error is returned,
+// unless opts.Recover is set, in which case the text is used as it is.
+func load_import(text string, names []string, opts LoadOptions, loader func(string) (*Node, error)) (*Node, error) {
+
+	if opts.RawCharset || utf8.ValidString(text) {
+		return loader(text)
+	}
+
+	var tried []string
+	var last_err error
+
+	for _, m := range []map[string]Charset{opts.Charsets, charsets} {
+		for _, name := range names {
+			cs, ok := find_charset(m, name)
+			if ok == false {
+				continue
+			}
+			decoded, err := cs.Decode([]byte(text))
+			if err != nil {
+				tried = append(tried, name)
+				last_err = err
+				continue
+			}
+			root, err := loader(decoded)
+			if err != nil {
+				return nil, err
+			}
+			declare_utf8(root)
+			return root, nil
+		}
+	}
+
+	if len(tried) > 0 && opts.Recover == false {
+		return nil, fmt.Errorf("load_import(): can't decode as %s: %v", strings.Join(tried, " or "), last_err)
+	}
+
+	return loader(text)
+}
+
+// declare_utf8 sets the CA property of the root to UTF-8 without changing the
+// order of the keys.
+func declare_utf8(root *Node) {
+	ki := root.key_index("CA")
+	if ki == -1 {
+		root.SetValue("CA", "UTF-8")
+		return
+	}
+	root.props[ki] = []string{"CA", "UTF-8"}				// Safe to do directly, CA is not a mutor.
+}
+
+// -------------------------------------------------------------------------------------
+
+type utf8_charset struct{}
+
+func (self utf8_charset) Decode(b []byte) (string, error) {
+	return string(b), nil
+}
+
+func (self utf8_charset) Encode(s string) ([]byte, error) {
+	return []byte(s), nil
+}
+
+type latin1_charset struct{}
+
+func (self latin1_charset) Decode(b []byte) (string, error) {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes), nil
+}
+
+func (self latin1_charset) Encode(s string) ([]byte, error) {
+	ret := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 255 {
+			return nil, fmt.Errorf("latin1_charset.Encode(): can't encode %q", r)
+		}
+		ret = append(ret, byte(r))
+	}
+	return ret, nil
+}
+
+type single_byte_charset struct {
+	table			[128]rune
+	reverse			map[rune]byte
+}
+
+func (self *single_byte_charset) Decode(b []byte) (string, error) {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		if c < 128 {
+			runes[i] = rune(c)
+		} else if self.table[c - 128] == utf8.RuneError {
+			return "", fmt.Errorf("single_byte_charset.Decode(): invalid byte 0x%x", c)
+		} else {
+			runes[i] = self.table[c - 128]
+		}
+	}
+	return string(runes), nil
+}
+
+func (self *single_byte_charset) Encode(s string) ([]byte, error) {
+	ret := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r < 128 {
+			ret = append(ret, byte(r))
+		} else if c, ok := self.reverse[r]; ok {
+			ret = append(ret, c)
+		} else {
+			return nil, fmt.Errorf("single_byte_charset.Encode(): can't encode %q", r)
+		}
+	}
+	return ret, nil
+}
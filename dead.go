@@ -0,0 +1,413 @@
+package sgf
+
+// Dead stone estimation, for scoring finished games. There are two parts:
+//
+//		* Benson's algorithm finds chains which are unconditionally alive, and the
+//		  regions they enclose which the opponent cannot make an eye in. Enemy stones
+//		  in such regions are certainly dead.
+//
+//		* Everything else is heuristic. For each colour, the board is split into
+//		  regions not containing that colour (so each is enclosed by it). Enemy stones
+//		  inside are grouped into units (chains sharing an eye or a liberty) and their
+//		  eyes are counted. Units with fewer than two eyes are candidates; the one
+//		  taking up the smallest share of its region is taken off, and the process is
+//		  repeated, since removing stones can give the other side its eyes.
+//
+// Seki is not recognised; one side of it will generally be marked dead.
+
+import (
+	"sort"
+)
+
+// An empty region of at least this size is counted as two eyes.
+const big_eye_size = 4
+
+// A DeadGroup is a chain of stones judged to be dead by Board.EstimateDead.
+type DeadGroup struct {
+	Colour			Colour
+	Stones			[]string			// Sorted.
+
+	// Certain is true if the chain is enclosed by unconditionally alive enemy
+	// stones, with no room for an eye. Otherwise the judgement is a heuristic.
+
+	Certain			bool
+}
+
+type board_chain struct {
+	colour			Colour
+	stones			[]string
+	libs			map[string]bool
+}
+
+// EstimateDead returns the chains it judges to be dead, in a position where the
+// game has ended. Unconditionally alive chains (per Benson's algorithm) are never
+// returned. The board is not changed.
+func (self *Board) EstimateDead() []*DeadGroup {
+
+	// Benson results from the original position...
+
+	alive := make(map[string]bool)			// Stones in unconditionally alive chains.
+	no_eye := make(map[string]bool)			// Points where the opponent of the enclosing colour can't live.
+
+	for _, colour := range []Colour{BLACK, WHITE} {
+		chains := self.chains(colour)
+		alive_chains, vital := self.benson(colour, chains)
+		for i, chain := range chains {
+			if alive_chains[i] {
+				for _, p := range chain.stones {
+					alive[p] = true
+				}
+			}
+		}
+		for _, region := range vital {
+			for _, p := range region {
+				no_eye[p] = true
+			}
+		}
+	}
+
+	work := self.Copy()
+	var ret []*DeadGroup
+
+	for {
+		unit, ok := work.weakest_unit(alive)
+		if ok == false {
+			break
+		}
+		for _, chain := range unit {
+			dg := &DeadGroup{Colour: chain.colour, Stones: chain.stones, Certain: true}
+			sort.Strings(dg.Stones)
+			for _, p := range chain.stones {
+				if no_eye[p] == false {
+					dg.Certain = false
+				}
+			}
+			ret = append(ret, dg)
+			work.DestroyGroup(chain.stones[0])
+		}
+	}
+
+	return ret
+}
+
+// chains returns all chains of the given colour, in board order.
+func (self *Board) chains(colour Colour) []*board_chain {
+
+	var ret []*board_chain
+	touched := make(map[string]bool)
+
+	for x := 0; x < self.Size; x++ {
+		for y := 0; y < self.Size; y++ {
+			p := Point(x, y)
+			if self.State[x][y] != colour || touched[p] {
+				continue
+			}
+			chain := &board_chain{colour: colour, stones: self.stones_recurse(p, colour, touched, nil), libs: make(map[string]bool)}
+			for _, s := range chain.stones {
+				for _, a := range AdjacentPoints(s, self.Size) {
+					if self.get_fast(a) == EMPTY {
+						chain.libs[a] = true
+					}
+				}
+			}
+			ret = append(ret, chain)
+		}
+	}
+
+	return ret
+}
+
+// regions_without returns every connected region of points not occupied by the
+// given colour, in board order.
+func (self *Board) regions_without(colour Colour) [][]string {
+
+	var ret [][]string
+	touched := make(map[string]bool)
+
+	for x := 0; x < self.Size; x++ {
+		for y := 0; y < self.Size; y++ {
+			p := Point(x, y)
+			if self.State[x][y] == colour || touched[p] {
+				continue
+			}
+			var region []string
+			queue := []string{p}
+			touched[p] = true
+			for len(queue) > 0 {
+				q := queue[0]
+				queue = queue[1:]
+				region = append(region, q)
+				for _, a := range AdjacentPoints(q, self.Size) {
+					if self.get_fast(a) != colour && touched[a] == false {
+						touched[a] = true
+						queue = append(queue, a)
+					}
+				}
+			}
+			ret = append(ret, region)
+		}
+	}
+
+	return ret
+}
+
+// benson runs Benson's algorithm for the colour. It returns which of the chains
+// are unconditionally alive, and the surviving regions which are vital to one of
+// them (i.e. every empty point is a liberty of that chain).
+func (self *Board) benson(colour Colour, chains []*board_chain) (map[int]bool, [][]string) {
+
+	chain_at := make(map[string]int)
+	for i, chain := range chains {
+		for _, p := range chain.stones {
+			chain_at[p] = i
+		}
+	}
+
+	regions := self.regions_without(colour)
+
+	neighbours := make([]map[int]bool, len(regions))		// Region --> adjacent chains.
+	vital_to := make([]map[int]bool, len(regions))			// Region --> chains it is vital to.
+
+	for r, region := range regions {
+
+		neighbours[r] = make(map[int]bool)
+		vital_to[r] = make(map[int]bool)
+
+		for _, p := range region {
+			for _, a := range AdjacentPoints(p, self.Size) {
+				if self.get_fast(a) == colour {
+					neighbours[r][chain_at[a]] = true
+				}
+			}
+		}
+
+		for i := range neighbours[r] {
+			vital := true
+			for _, p := range region {
+				if self.get_fast(p) == EMPTY && chains[i].libs[p] == false {
+					vital = false
+					break
+				}
+			}
+			if vital {
+				vital_to[r][i] = true
+			}
+		}
+	}
+
+	alive := make(map[int]bool)
+	for i := range chains {
+		alive[i] = true
+	}
+
+	healthy := make(map[int]bool)
+	for r := range regions {
+		healthy[r] = true
+	}
+
+	for {
+
+		changed := false
+
+		for i := range alive {
+			count := 0
+			for r := range healthy {
+				if vital_to[r][i] {
+					count++
+				}
+			}
+			if count < 2 {
+				delete(alive, i)
+				changed = true
+			}
+		}
+
+		for r := range healthy {
+			for i := range neighbours[r] {
+				if alive[i] == false {
+					delete(healthy, r)
+					changed = true
+					break
+				}
+			}
+		}
+
+		if changed == false {
+			break
+		}
+	}
+
+	var vital [][]string
+	for r := range regions {
+		if healthy[r] && len(vital_to[r]) > 0 {
+			vital = append(vital, regions[r])
+		}
+	}
+
+	return alive, vital
+}
+
+// weakest_unit finds, over both colours, the unit of chains with fewer than two
+// eyes which takes up the smallest share of the enemy-enclosed region it is in.
+// Chains containing stones in the alive map are never considered.
+func (self *Board) weakest_unit(alive map[string]bool) ([]*board_chain, bool) {
+
+	var best []*board_chain
+	best_share := 2.0
+
+	for _, colour := range []Colour{BLACK, WHITE} {
+
+		chains := self.chains(colour)
+		if len(chains) == 0 {
+			continue
+		}
+
+		chain_at := make(map[string]int)
+		for i, chain := range chains {
+			for _, p := range chain.stones {
+				chain_at[p] = i
+			}
+		}
+
+		// Union chains which share a liberty or an eye into units...
+
+		parent := make([]int, len(chains))
+		for i := range parent {
+			parent[i] = i
+		}
+		var find func(int) int
+		find = func(i int) int {
+			if parent[i] != i {
+				parent[i] = find(parent[i])
+			}
+			return parent[i]
+		}
+		union := func(a, b int) {
+			parent[find(a)] = find(b)
+		}
+
+		lib_owner := make(map[string]int)
+		for i, chain := range chains {
+			for p := range chain.libs {
+				if j, ok := lib_owner[p]; ok {
+					union(i, j)
+				} else {
+					lib_owner[p] = i
+				}
+			}
+		}
+
+		// Eyes are empty regions bordered only by this colour...
+
+		eyes := make(map[int]int)			// Chain --> eye value, added to its root later.
+
+		for _, region := range self.empty_regions() {
+
+			if self.region_owner(region) != colour {
+				continue
+			}
+
+			adjacent := -1
+
+			for _, p := range region {
+				for _, a := range AdjacentPoints(p, self.Size) {
+					if self.get_fast(a) == colour {
+						if adjacent == -1 {
+							adjacent = chain_at[a]
+						} else {
+							union(adjacent, chain_at[a])
+						}
+					}
+				}
+			}
+
+			if adjacent != -1 {
+				value := 1
+				if len(region) >= big_eye_size {
+					value = 2
+				}
+				eyes[adjacent] += value
+			}
+		}
+
+		// Gather units, along with the size of the enemy-enclosed region each is in...
+
+		region_size := make(map[string]int)
+		for _, region := range self.regions_without(colour.Opposite()) {
+			for _, p := range region {
+				region_size[p] = len(region)
+			}
+		}
+
+		units := make(map[int][]*board_chain)
+		unit_eyes := make(map[int]int)
+		unit_stones := make(map[int]int)
+		unit_safe := make(map[int]bool)
+		var order []int
+
+		for i, chain := range chains {
+			root := find(i)
+			if _, ok := units[root]; ok == false {
+				order = append(order, root)
+			}
+			units[root] = append(units[root], chain)
+			unit_stones[root] += len(chain.stones)
+			if alive[chain.stones[0]] {
+				unit_safe[root] = true
+			}
+		}
+
+		for i, value := range eyes {
+			unit_eyes[find(i)] += value
+		}
+
+		for _, root := range order {
+			if unit_safe[root] || unit_eyes[root] >= 2 {
+				continue
+			}
+			share := float64(unit_stones[root]) / float64(region_size[units[root][0].stones[0]])
+			if share < best_share {
+				best = units[root]
+				best_share = share
+			}
+		}
+	}
+
+	return best, best != nil
+}
+
+// MarkTerritory estimates the dead stones at the node (see Board.EstimateDead)
+// and records the resulting territory as TB and TW markup on the node, replacing
+// any already present. Dead stones are included in the territory they lie in,
+// so Node.Score will treat them as dead. This is intended for the last node of a
+// finished game. The dead groups are returned.
+func (self *Node) MarkTerritory() []*DeadGroup {
+
+	board := self.Board()
+	dead := board.EstimateDead()
+
+	work := board.Copy()
+	for _, dg := range dead {
+		work.DestroyGroup(dg.Stones[0])
+	}
+
+	territory := map[Colour][]string{}
+
+	for _, region := range work.empty_regions() {
+		if owner := work.region_owner(region); owner != EMPTY {
+			territory[owner] = append(territory[owner], region...)
+		}
+	}
+
+	for _, item := range []struct{key string; colour Colour}{{"TB", BLACK}, {"TW", WHITE}} {
+		points := territory[item.colour]
+		if len(points) == 0 {
+			self.DeleteKey(item.key)
+		} else {
+			sort.Strings(points)
+			self.SetValues(item.key, CompressPoints(points, board.Size))
+		}
+	}
+
+	return dead
+}
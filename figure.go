@@ -0,0 +1,198 @@
+package sgf
+
+// Printed figures, as in books: a game is split into diagrams of a few dozen
+// moves each. Each diagram shows the position at its start, plus its moves,
+// numbered on the points where they were played. A move on a point already
+// showing a stone in the diagram (e.g. a ko recapture) is instead given in a
+// note below, e.g. "12 at 5".
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Figure is one diagram in a printed game record, as produced by
+// Node.Figures().
+type Figure struct {
+	First			int					// Number of the first move in the figure.
+	Last			int					// Number of the last move in the figure.
+
+	// Board holds the stones to draw: the position at the start of the figure,
+	// plus the figure's moves, where shown. Stones captured during the figure
+	// are still drawn, as is conventional.
+
+	Board			*Board
+
+	Numbers			map[string]int		// Point --> number of the move shown there.
+	Notes			[]string			// Moves not shown on the board, e.g. "12 at 5" or "13 pass".
+}
+
+// Figures splits the line of play through the node (i.e. its ancestors, then
+// the main line onwards) into figures of up to moves_per_figure moves each.
+// Moves are numbered from the start of the game. Moves on points showing a
+// stone from before the figure are noted with the point's GTP coordinate, e.g.
+// "20 at Q16".
+func (self *Node) Figures(moves_per_figure int) ([]*Figure, error) {
+
+	if moves_per_figure < 1 {
+		return nil, fmt.Errorf("Figures(): bad moves_per_figure %d", moves_per_figure)
+	}
+
+	line := full_line(self)
+	size := line[0].RootBoardSize()
+
+	actual := NewBoard(size)			// The real position, with captures.
+	var fig *Figure
+	var ret []*Figure
+	n := 0
+
+	for _, node := range line {
+
+		// Setup is applied to both the real position and the diagram...
+
+		for _, item := range []struct{key string; colour Colour}{{"AB", BLACK}, {"AW", WHITE}, {"AE", EMPTY}} {
+			for _, p := range point_values(node, item.key, size) {
+				actual.Set(p, item.colour)
+				if fig != nil {
+					fig.Board.Set(p, item.colour)
+					delete(fig.Numbers, p)
+				}
+			}
+		}
+
+		for _, key := range []string{"B", "W"} {
+
+			value, ok := node.GetValue(key)
+			if ok == false {
+				continue
+			}
+
+			colour := BLACK; if key == "W" { colour = WHITE }
+			n++
+
+			if fig == nil || n > fig.First + moves_per_figure - 1 {
+				fig = &Figure{First: n, Board: actual.Copy(), Numbers: make(map[string]int)}
+				fig.Board.ClearKo()
+				ret = append(ret, fig)
+			}
+			fig.Last = n
+
+			actual.ForceStone(value, colour)
+
+			if ValidPoint(value, size) == false {
+				fig.Notes = append(fig.Notes, fmt.Sprintf("%d pass", n))
+			} else if fig.Board.Get(value) == EMPTY {
+				fig.Board.Set(value, colour)
+				fig.Numbers[value] = n
+			} else if shown, ok := fig.Numbers[value]; ok {
+				fig.Notes = append(fig.Notes, fmt.Sprintf("%d at %d", n, shown))
+			} else {
+				fig.Notes = append(fig.Notes, fmt.Sprintf("%d at %s", n, figure_coordinate(value, size)))
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+func figure_coordinate(p string, size int) string {
+	if s := GTP(p, size); s != "" {
+		return s
+	}
+	return p
+}
+
+// Title returns a title for the figure, e.g. "Moves 1-50".
+func (self *Figure) Title() string {
+	if self.First == self.Last {
+		return fmt.Sprintf("Move %d", self.First)
+	}
+	return fmt.Sprintf("Moves %d-%d", self.First, self.Last)
+}
+
+// String returns the figure in ASCII, with its title and notes. Stones from
+// before the figure are X and O; the figure's moves are shown by number, in
+// which case the colour can be worked out from the numbering.
+func (self *Figure) String() string {
+
+	var b bytes.Buffer
+
+	b.WriteString(self.Title())
+	b.WriteString("\n")
+
+	for y := 0; y < self.Board.Size; y++ {
+		for x := 0; x < self.Board.Size; x++ {
+			p := Point(x, y)
+			if number, ok := self.Numbers[p]; ok {
+				fmt.Fprintf(&b, "%4d", number)
+			} else if self.Board.State[x][y] == BLACK {
+				b.WriteString("   X")
+			} else if self.Board.State[x][y] == WHITE {
+				b.WriteString("   O")
+			} else if IsStarPoint(p, self.Board.Size) {
+				fmt.Fprintf(&b, "%4s", HoshiString)
+			} else {
+				b.WriteString("   .")
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	for _, line := range wrap_notes(self.Notes, self.Board.Size * 4) {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// SVG returns the figure as an SVG diagram, with its notes below. The options
+// LastMove and MoveNumbers are ignored.
+func (self *Figure) SVG(opts SVGOptions) string {
+
+	opts.LastMove = ""
+	opts.MoveNumbers = 0
+
+	d := new_svg_diagram(self.Board, opts)
+
+	for p, number := range self.Numbers {
+		d.labels[p] = strconv.Itoa(number)
+	}
+
+	d.caption = wrap_notes(self.Notes, self.Board.Size * 3)
+
+	return d.render()
+}
+
+// wrap_notes joins the notes with commas, into lines of roughly the given
+// width.
+func wrap_notes(notes []string, width int) []string {
+
+	var ret []string
+	var line []string
+	length := 0
+
+	for i, note := range notes {
+		if i < len(notes) - 1 {
+			note += ","
+		}
+		if len(line) > 0 && length + 1 + len(note) > width {
+			ret = append(ret, strings.Join(line, " "))
+			line = nil
+			length = 0
+		}
+		if len(line) > 0 {
+			length++
+		}
+		line = append(line, note)
+		length += len(note)
+	}
+
+	if len(line) > 0 {
+		ret = append(ret, strings.Join(line, " "))
+	}
+
+	return ret
+}
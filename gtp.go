@@ -0,0 +1,92 @@
+package sgf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GTPCommands returns the GTP commands that set up an engine's board to match
+// the position at the node, by replaying the line leading to it: boardsize,
+// clear_board, komi (if known), set_free_handicap for handicap stones, and then
+// play for each move. Other setup stones are sent as play commands, black
+// first. An error is returned for things GTP cannot express, i.e. AE, or a
+// board size over 25.
+func (self *Node) GTPCommands() ([]string, error) {
+
+	line := self.GetLine()
+	root := line[0]
+	size := root.RootBoardSize()
+
+	if size > 25 {
+		return nil, fmt.Errorf("GTPCommands(): board size %d is too large for GTP", size)
+	}
+
+	ret := []string{"boardsize " + strconv.Itoa(size), "clear_board"}
+
+	if km, ok := root.GetValue("KM"); ok {
+		if _, err := strconv.ParseFloat(km, 64); err == nil {
+			ret = append(ret, "komi " + km)
+		}
+	}
+
+	vertices := func(node *Node, key string) ([]string, error) {
+		var ret []string
+		for _, value := range node.AllValues(key) {
+			points := ParsePointList(value, size)
+			if points == nil {
+				points = []string{value}
+			}
+			for _, p := range points {
+				vertex := GTP(p, size)
+				if vertex == "" {
+					return nil, fmt.Errorf("GTPCommands(): bad point %q in %s", p, key)
+				}
+				ret = append(ret, vertex)
+			}
+		}
+		return ret, nil
+	}
+
+	for i, node := range line {
+
+		if node.ValueCount("AE") > 0 {
+			return nil, fmt.Errorf("GTPCommands(): can't express AE property")
+		}
+
+		ab, err := vertices(node, "AB")
+		if err != nil {
+			return nil, err
+		}
+		aw, err := vertices(node, "AW")
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 && len(ab) >= 2 && len(aw) == 0 {
+			ret = append(ret, "set_free_handicap " + strings.Join(ab, " "))
+		} else {
+			for _, vertex := range ab {
+				ret = append(ret, "play b " + vertex)
+			}
+		}
+
+		for _, vertex := range aw {
+			ret = append(ret, "play w " + vertex)
+		}
+
+		for _, key := range []string{"B", "W"} {
+			value, ok := node.GetValue(key)
+			if ok == false {
+				continue
+			}
+			vertex := "pass"
+			if ValidPoint(value, size) {
+				vertex = GTP(value, size)
+			}
+			ret = append(ret, "play " + strings.ToLower(key) + " " + vertex)
+		}
+	}
+
+	return ret, nil
+}
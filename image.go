@@ -0,0 +1,175 @@
+package sgf
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+)
+
+// Raster rendering, using only the standard library. Images are paletted, so
+// the same drawing code serves for GIF frames.
+
+var image_palette = color.Palette{
+	color.RGBA{0xdc, 0xb3, 0x5c, 0xff},				// Board
+	color.RGBA{0x00, 0x00, 0x00, 0xff},				// Black
+	color.RGBA{0xff, 0xff, 0xff, 0xff},				// White
+	color.RGBA{0xd0, 0x20, 0x20, 0xff},				// Markers
+}
+
+const (
+	pal_board = uint8(iota)
+	pal_black
+	pal_white
+	pal_marker
+)
+
+const image_cell_size = 24
+
+// Image returns a picture of the board, including the ko square (if any). The
+// distance between lines is 24 pixels. The result can be saved with the
+// image/png package, for example.
+func (self *Board) Image() image.Image {
+	return self.paletted_image(image_cell_size, "")
+}
+
+// AnimatedGIF returns an animation of the line of play through the node (i.e.
+// its ancestors, then the main line onwards), with one frame for the position
+// after each move from the move numbered from to the move numbered to,
+// inclusive. Move 0 is the position before any moves. The last move is marked
+// in each frame. The result can be saved with gif.EncodeAll().
+func (self *Node) AnimatedGIF(from, to int) (*gif.GIF, error) {
+
+	// positions[n] is the board with n moves played, and moves[n] is the nth move
+	// itself. The line is replayed on a single board, since a node can hold both
+	// B and W, or hold a move and setup (e.g. a move on the root)...
+
+	line := full_line(self)
+
+	work := NewBoard(line[0].RootBoardSize())
+	positions := []*Board{work.Copy()}
+	moves := []string{""}
+
+	for _, node := range line {
+
+		for _, item := range []struct{key string; colour Colour}{{"AB", BLACK}, {"AW", WHITE}, {"AE", EMPTY}} {
+			for _, p := range node.AllValues(item.key) {
+				if len(p) == 5 && p[2] == ':' {
+					work.AddList(p, item.colour)
+				} else {
+					work.AddStone(p, item.colour)
+				}
+			}
+		}
+
+		positions[len(positions) - 1] = work.Copy()			// Setup changes the current frame.
+
+		for _, key := range []string{"B", "W"} {
+			colour := BLACK; if key == "W" { colour = WHITE }
+			for _, mv := range node.AllValues(key) {
+				work.ForceStone(mv, colour)
+				positions = append(positions, work.Copy())
+				moves = append(moves, mv)
+			}
+		}
+	}
+
+	if from < 0 || from > to || to >= len(positions) {
+		return nil, fmt.Errorf("AnimatedGIF(): bad range %d-%d, with %d moves available", from, to, len(positions) - 1)
+	}
+
+	ret := new(gif.GIF)
+
+	for n := from; n <= to; n++ {
+
+		img := positions[n].paletted_image(image_cell_size, moves[n])
+		ret.Image = append(ret.Image, img)
+
+		if n == to {
+			ret.Delay = append(ret.Delay, 300)			// Units of 1/100 seconds.
+		} else {
+			ret.Delay = append(ret.Delay, 100)
+		}
+	}
+
+	return ret, nil
+}
+
+func (self *Board) paletted_image(cell int, last_move string) *image.Paletted {
+
+	size := self.Size
+	margin := cell
+	width := margin * 2 + cell * (size - 1)
+
+	img := image.NewPaletted(image.Rect(0, 0, width, width), image_palette)		// Starts with index 0 everywhere.
+
+	at := func(n int) int {
+		return margin + cell * n
+	}
+
+	// Grid...
+
+	for n := 0; n < size; n++ {
+		for i := at(0); i <= at(size - 1); i++ {
+			img.SetColorIndex(i, at(n), pal_black)
+			img.SetColorIndex(at(n), i, pal_black)
+		}
+	}
+
+	// Hoshi...
+
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			if IsStarPoint(Point(x, y), size) {
+				fill_circle(img, at(x), at(y), float64(cell) * 0.12, pal_black)
+			}
+		}
+	}
+
+	// Stones...
+
+	radius := float64(cell) * 0.48
+
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			switch self.State[x][y] {
+			case BLACK:
+				fill_circle(img, at(x), at(y), radius, pal_black)
+			case WHITE:
+				fill_circle(img, at(x), at(y), radius, pal_black)
+				fill_circle(img, at(x), at(y), radius - 1, pal_white)
+			}
+		}
+	}
+
+	// Ko square...
+
+	if x, y, onboard := ParsePoint(self.Ko, size); onboard && self.State[x][y] == EMPTY {
+		half := cell / 4
+		for i := -half; i <= half; i++ {
+			img.SetColorIndex(at(x) + i, at(y) - half, pal_black)
+			img.SetColorIndex(at(x) + i, at(y) + half, pal_black)
+			img.SetColorIndex(at(x) - half, at(y) + i, pal_black)
+			img.SetColorIndex(at(x) + half, at(y) + i, pal_black)
+		}
+	}
+
+	// Last move...
+
+	if x, y, onboard := ParsePoint(last_move, size); onboard && self.State[x][y] != EMPTY {
+		fill_circle(img, at(x), at(y), float64(cell) * 0.18, pal_marker)
+	}
+
+	return img
+}
+
+func fill_circle(img *image.Paletted, cx, cy int, r float64, index uint8) {
+	n := int(r) + 1
+	for dx := -n; dx <= n; dx++ {
+		for dy := -n; dy <= n; dy++ {
+			if float64(dx * dx + dy * dy) <= r * r {
+				img.SetColorIndex(cx + dx, cy + dy, index)
+			}
+		}
+	}
+}
@@ -3,10 +3,15 @@ package sgf
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 )
 
@@ -15,36 +20,166 @@ import (
 // location of the nodes in their trees is irrelevant: in each case, the whole
 // tree is always saved.
 func SaveCollection(nodes []*Node, filename string) error {
+	return SaveCollectionOptions(nodes, filename, WriteOptions{})
+}
 
-	var roots []*Node
+// SaveCollectionOptions is like SaveCollection, but the output is adjusted by
+// the given options.
+//
+// Saving is atomic: the trees are written to a temporary file in the same
+// directory, which is synced to disk and only then renamed over the target.
+// Thus, on failure, any existing file is left untouched.
+func SaveCollectionOptions(nodes []*Node, filename string, opts WriteOptions) error {
 
-	for _, node := range nodes {
-		if node != nil {
-			roots = append(roots, node.GetRoot())		// Note that node.Save() relies on GetRoot() here.
+	roots, err := collection_roots(nodes)
+	if err != nil {
+		return err
+	}
+
+	return save_atomic(filename, func(w io.Writer) error {
+		return write_collection(w, roots, opts)
+	})
+}
+
+// save_atomic calls write() with a writer for a temporary file in the same
+// directory as the target, which is synced to disk and then renamed over the
+// target, after which the directory is synced too. If the target is a symlink,
+// the file it points to is replaced instead, leaving the link intact. On
+// failure, the temporary file is removed.
+func save_atomic(filename string, write func(w io.Writer) error) error {
+
+	filename = resolve_symlink(filename)
+
+	outfile, err := ioutil.TempFile(filepath.Dir(filename), "." + filepath.Base(filename) + ".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	err = save_to_file(outfile, write)
+	if err == nil {
+		err = outfile.Close()		// Close must happen before the rename, for the sake of Windows.
+	} else {
+		outfile.Close()
+	}
+
+	if err == nil {
+		perm := os.FileMode(0644)
+		if info, stat_err := os.Stat(filename); stat_err == nil {
+			perm = info.Mode().Perm()
 		}
+		err = os.Chmod(outfile.Name(), perm)
 	}
 
-	if len(roots) == 0 {
-		return fmt.Errorf("SaveCollection(): No non-nil roots supplied")
+	if err == nil {
+		err = os.Rename(outfile.Name(), filename)
 	}
 
-	outfile, err := os.Create(filename)
 	if err != nil {
+		os.Remove(outfile.Name())
 		return err
 	}
 
+	return sync_dir(filepath.Dir(filename))		// Without this, the rename itself might not survive a crash.
+}
+
+// resolve_symlink returns the file a symlink points to (following any chain of
+// links), or the filename itself if it isn't a symlink, or the link is broken.
+func resolve_symlink(filename string) string {
+
+	info, err := os.Lstat(filename)
+	if err != nil || info.Mode() & os.ModeSymlink == 0 {
+		return filename
+	}
+
+	resolved, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		return filename
+	}
+
+	return resolved
+}
+
+// sync_dir flushes a directory's entries to disk. Windows can't do this, nor
+// does it need to, so it is skipped there.
+func sync_dir(dir string) error {
+
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	d.Close()
+	return err
+}
+
+func save_to_file(outfile *os.File, write func(w io.Writer) error) error {
+
 	w := bufio.NewWriter(outfile)		// bufio for speedier output if file is huge.
-	for _, root := range roots {
-		root.write_tree(w)
+
+	err := write(w)
+	if err != nil {
+		return err
 	}
-	w.Flush()							// "After all data has been written, the client should call the Flush method"
 
-	// We didn't defer outfile.Close() like normal people so we can check its error here, just in case...
+	err = w.Flush()						// "After all data has been written, the client should call the Flush method"
+	if err != nil {
+		return err
+	}
+
+	return outfile.Sync()
+}
+
+// SaveCollectionTo writes each tree given to an io.Writer, in the same format
+// as SaveCollection. Any error from the writer is returned.
+func SaveCollectionTo(w io.Writer, nodes []*Node) error {
+	return SaveCollectionToOptions(w, nodes, WriteOptions{})
+}
 
-	err = outfile.Close()
+// SaveCollectionToOptions is like SaveCollectionTo, but the output is adjusted
+// by the given options.
+func SaveCollectionToOptions(w io.Writer, nodes []*Node, opts WriteOptions) error {
+	roots, err := collection_roots(nodes)
 	if err != nil {
 		return err
 	}
+	return write_collection(w, roots, opts)
+}
+
+func collection_roots(nodes []*Node) ([]*Node, error) {
+
+	var roots []*Node
+
+	for _, node := range nodes {
+		if node != nil {
+			roots = append(roots, node.GetRoot())		// Note that node.Save() relies on GetRoot() here.
+		}
+	}
+
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("SaveCollection(): No non-nil roots supplied")
+	}
+
+	return roots, nil
+}
+
+func write_collection(w io.Writer, roots []*Node, opts WriteOptions) error {
+
+	tw, err := new_tree_writer(w, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, root := range roots {
+		err = tw.write_tree(root)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -56,6 +191,11 @@ func (self *Node) Save(filename string) error {
 	return SaveCollection([]*Node{self}, filename)		// Not using self.GetRoot() since SaveCollection does.
 }
 
+// SaveOptions is like Save, but the output is adjusted by the given options.
+func (self *Node) SaveOptions(filename string, opts WriteOptions) error {
+	return SaveCollectionOptions([]*Node{self}, filename, opts)
+}
+
 // SGF returns the entire tree as a string in SGF format.
 func (self *Node) SGF() string {
 	if self == nil {
@@ -66,33 +206,42 @@ func (self *Node) SGF() string {
 	return buf.String()
 }
 
-func (self *Node) write_tree(w io.Writer) {
-
-	node := self
-
-	fmt.Fprint(w, "(")
-
-	for {
-		node.WriteTo(w)
-		if len(node.children) > 1 {
-			for _, child := range node.children {
-				child.write_tree(w)
-			}
-			break
-		} else if len(node.children) == 1 {
-			node = node.children[0]
-			continue
-		} else {
-			break
-		}
+// SGFOptions is like SGF, but the output is adjusted by the given options. An
+// error is returned if the output cannot be generated, e.g. because a value
+// cannot be represented in the requested character set.
+func (self *Node) SGFOptions(opts WriteOptions) (string, error) {
+	if self == nil {
+		return "<nil>", nil
 	}
+	var buf bytes.Buffer
+	tw, err := new_tree_writer(&buf, opts)
+	if err != nil {
+		return "", err
+	}
+	err = tw.write_tree(self.GetRoot())
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
 
-	fmt.Fprint(w, ")")
-
-	// We could print a newline...
-	// fmt.Fprint(w, "\n")
+// CanonicalHash returns a hash (SHA-256, as hex) of the entire tree, written in
+// canonical form. Trees that differ only in the order of their keys or values,
+// or in how passes or point lists are written, have the same hash. A nil node
+// gives "".
+func (self *Node) CanonicalHash() string {
+	if self == nil {
+		return ""
+	}
+	h := sha256.New()
+	tw, _ := new_tree_writer(h, WriteOptions{Canonical: true})		// Can't fail with no charset.
+	tw.write_tree(self.GetRoot())
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-	return
+func (self *Node) write_tree(w io.Writer) error {
+	tw, _ := new_tree_writer(w, WriteOptions{})			// Can't fail with default options.
+	return tw.write_tree(self)
 }
 
 func escape_string(s string) string {
@@ -111,160 +260,70 @@ func escape_string(s string) string {
 	return buf.String()
 }
 
-// Load reads an SGF file (or GIB or NGF file, if the filename has that
-// extension) creating a tree of SGF nodes, and returning the root. The input
-// file is closed automatically. If the file has more than one SGF tree (a
-// rarity) only the first is loaded - use LoadCollection() for such files
-// instead.
+// Load reads a file, creating a tree of SGF nodes, and returning the root. The
+// input file is closed automatically. As well as SGF, the GIB, NGF, UGF (or
+// UGI) and OGS JSON formats are understood, as is this library's own JSON (see
+// Node.MarshalJSON). The format is detected from the contents (see
+// DetectFormat), falling back on the extension. If the file has more than one
+// SGF tree (a rarity) only the first is loaded - use LoadCollection() for such
+// files instead.
 func Load(filename string) (*Node, error) {
 
-	file_bytes, err := ioutil.ReadFile(filename)
-
+	infile, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer infile.Close()
 
-	data := string(file_bytes)
+	reader := bufio.NewReaderSize(infile, 8192)
 
-	// If RAM wastage was ever an issue, one can do the super-spooky:
-	// data := *(*string)(unsafe.Pointer(&file_bytes))
-	// See https://github.com/golang/go/issues/25484 for details.
+	head, err := reader.Peek(8192)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
 
-	root, _, err := load_sgf_tree(data, nil)
+	format := DetectFormat(head)
+	if format == UNKNOWN_FORMAT {
+		format = format_from_extension(filename)
+	}
 
-	if err != nil {
-		if strings.HasSuffix(strings.ToLower(filename), ".gib") {
-			root, err = LoadGIB(data)
-		} else if strings.HasSuffix(strings.ToLower(filename), ".ngf") {
-			root, err = LoadNGF(data)
-		}
+	if format == SGF_FORMAT || format == UNKNOWN_FORMAT {
+		return LoadReader(reader)
 	}
 
+	// The other formats are small, so just read the whole thing.
+
+	file_bytes, err := ioutil.ReadAll(reader)
 	if err != nil {
 		return nil, err
 	}
 
-	return root, nil
+	switch format {
+	case GIB_FORMAT:
+		return LoadGIBOptions(string(file_bytes), LoadOptions{})
+	case NGF_FORMAT:
+		return LoadNGF(string(file_bytes))
+	case UGF_FORMAT:
+		return LoadUGFOptions(string(file_bytes), LoadOptions{})
+	case JSON_FORMAT:
+		return LoadOGSJSON(string(file_bytes))
+	case NODE_JSON_FORMAT:
+		root := NewNode(nil)
+		err = json.Unmarshal(file_bytes, root)
+		if err != nil {
+			return nil, err
+		}
+		return root, nil
+	}
+
+	return nil, fmt.Errorf("Load(): %s files are not supported", format)
 }
 
 // LoadSGF parses an SGF string, creating a tree of SGF nodes, and returns the
 // root. If the string has more than one SGF tree only the first is loaded - use
 // LoadCollectionSGF() for such strings instead.
 func LoadSGF(sgf string) (*Node, error) {
-	root, _, err := load_sgf_tree(sgf, nil)
-	return root, err
-}
-
-func load_sgf_tree(sgf string, parent_of_local_root *Node) (*Node, int, error) {
-
-	// A tree is whatever is between ( and ).
-	//
-	// FIXME: this is not unicode aware. Potential problems exist if
-	// a unicode code point contains a meaningful character, especially
-	// the bytes ] and \ although this is impossible for utf-8.
-
-	var root *Node
-	var node *Node
-	var tree_started bool
-	var inside_value bool
-	var value bytes.Buffer						// I used to use string and += string(c), but
-	var key bytes.Buffer						// ran into https://play.golang.org/p/435YV7klTuI
-	var keycomplete bool
-
-	for i := 0; i < len(sgf); i++ {
-
-		c := sgf[i]
-
-		if tree_started == false {
-			if c <= ' ' {						// Reasonable definition of whitespace, where ' ' is byte 32.
-				continue
-			} else if c == '(' {
-				tree_started = true
-				continue
-			} else {
-				return nil, 0, fmt.Errorf("load_sgf_tree(): unexpected byte 0x%x before (", c)
-			}
-		}
-
-		if inside_value {
-
-			if c == '\\' {
-				if len(sgf) <= i + 1 {
-					return nil, 0, fmt.Errorf("load_sgf_tree(): escape character at end of input")
-				}
-				value.WriteByte(sgf[i + 1])
-				i++								// Skip 1 character.
-			} else if c == ']' {
-				inside_value = false
-				if node == nil {
-					return nil, 0, fmt.Errorf("load_sgf_tree(): value ended by ] but node was nil")
-				}
-				node.AddValue(key.String(), value.String())
-			} else {
-				value.WriteByte(c)
-			}
-
-		} else {
-
-			if c <= ' ' || (c >= 'a' && c <= 'z') {
-				continue												// Silently discard whitespace and lowercase ASCII
-			} else if c == '[' {
-				if node == nil {
-					// The tree has ( but no ; before its first property. We could return an error.
-					// Alternatively, we can tolerate this...
-					node = NewNode(parent_of_local_root)
-					root = node											// First node we saw in the tree.
-				}
-				value.Reset()
-				inside_value = true
-				keycomplete = true
-				if key.String() == "" {
-					return nil, 0, fmt.Errorf("load_sgf_tree(): value started with [ but key was \"\"")
-				}
-			} else if c == '(' {
-				if node == nil {
-					return nil, 0, fmt.Errorf("load_sgf_tree(): new subtree started but node was nil")
-				}
-				_, chars_to_skip, err := load_sgf_tree(sgf[i:], node)	// Substrings are memory efficient in Golang.
-				if err != nil {
-					return nil, 0, err
-				}
-				i += chars_to_skip - 1		// Subtract 1: the ( character we have read is also counted by the recurse.
-			} else if c == ')' {
-				if root == nil {
-					return nil, 0, fmt.Errorf("load_sgf_tree(): subtree ended but local root was nil")
-				}
-				return root, i + 1, nil									// Return characters read.
-			} else if c == ';' {
-				if node == nil {
-					node = NewNode(parent_of_local_root)
-					root = node											// First node we saw in the tree.
-				} else {
-					node = NewNode(node)
-				}
-				key.Reset()
-				keycomplete = false
-			} else if c >= 'A' && c <= 'Z' {
-				if keycomplete {
-					key.Reset()
-					keycomplete = false
-				}
-				key.WriteByte(c)
-			} else {
-				return nil, 0, fmt.Errorf("load_sgf_tree(): unacceptable byte 0x%x while expecting key", c)
-			}
-		}
-	}
-
-	if root == nil {
-		return nil, 0, fmt.Errorf("load_sgf_tree(): local root was nil at function end")
-	}
-
-	// Just being here must mean we reached the actual end of the file without
-	// reading a final ')' character. Still, we can return what we have.
-	// Note that load_special() relies on this.
-
-	return root, len(sgf), nil		// Return characters read.
+	return LoadReader(strings.NewReader(sgf))
 }
 
 // LoadCollection loads an SGF file, possibly creating many trees, and returns a
@@ -274,34 +333,39 @@ func load_sgf_tree(sgf string, parent_of_local_root *Node) (*Node, int, error) {
 // which case a slice of length 1 will be returned.
 func LoadCollection(filename string) ([]*Node, error) {
 
-	file_bytes, err := ioutil.ReadFile(filename)
+	infile, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer infile.Close()
 
-	return LoadCollectionSGF(string(file_bytes))
+	return load_collection(infile)
 }
 
 // LoadCollectionSGF parses an SGF string, possibly creating many trees, and
 // returns a slice of all root nodes created.
 func LoadCollectionSGF(sgf string) ([]*Node, error) {
+	return load_collection(strings.NewReader(sgf))
+}
+
+func load_collection(r io.Reader) ([]*Node, error) {
+
 	var ret []*Node
-	sgf = strings.TrimSpace(sgf)		// Otherwise any trailing characters will trigger an extra attempt to read a tree.
+
+	decoder := NewDecoder(r)
 
 	for {
-		if len(sgf) == 0 {
+		root, err := decoder.Decode()
+
+		if err == io.EOF {
 			return ret, nil
 		}
 
-		root, chars_read, err := load_sgf_tree(sgf, nil)
-
 		if err != nil {
 			return ret, err
 		}
 
 		ret = append(ret, root)
-
-		sgf = sgf[chars_read:]
 	}
 }
 
@@ -341,8 +405,7 @@ func load_special(filename string, root_only bool) (*Node, error) {
 	for {
 		c, err := reader.ReadByte()
 		if err != nil {
-			root, _, err := load_sgf_tree(data.String(), nil)
-			return root, err
+			return LoadSGF(data.String())
 		}
 		data.WriteByte(c)
 
@@ -365,15 +428,13 @@ func load_special(filename string, root_only bool) (*Node, error) {
 				continue
 			}
 			if c == ')' {
-				root, _, err := load_sgf_tree(data.String(), nil)
-				return root, err
+				return LoadSGF(data.String())
 			}
 			if c == ';' {
 				semicolons++
 				if root_only && semicolons >= 2 {
 					data.Truncate(data.Len() - 1)		// Delete the second ; from the data.
-					root, _, err := load_sgf_tree(data.String(), nil)
-					return root, err
+					return LoadSGF(data.String())
 				}
 				continue
 			}
@@ -381,8 +442,7 @@ func load_special(filename string, root_only bool) (*Node, error) {
 				brackets++
 				if root_only && brackets >= 2 {
 					data.Truncate(data.Len() - 1)		// Delete the second ( from the data.
-					root, _, err := load_sgf_tree(data.String(), nil)
-					return root, err
+					return LoadSGF(data.String())
 				}
 				continue
 			}
@@ -0,0 +1,108 @@
+package sgf
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// A CollectionReader reads the games of an SGF collection one at a time, so
+// that collections of any size can be processed without holding them in
+// memory. It can also read just the root of a game, which allows unwanted games
+// to be skipped without building their trees.
+type CollectionReader struct {
+	decoder			*Decoder
+	closer			io.Closer		// nil unless we opened the file ourselves.
+	root			*Node			// Root of a game read by NextRoot(), until finished or skipped.
+}
+
+// NewCollectionReader returns a CollectionReader that reads from r.
+func NewCollectionReader(r io.Reader) *CollectionReader {
+	return NewCollectionReaderOptions(r, LoadOptions{})
+}
+
+// NewCollectionReaderOptions is like NewCollectionReader, but the parser's
+// behaviour is adjusted by the given options.
+func NewCollectionReaderOptions(r io.Reader, opts LoadOptions) *CollectionReader {
+	return &CollectionReader{decoder: NewDecoderOptions(r, opts)}
+}
+
+// OpenCollection opens an SGF file for reading one game at a time. The caller
+// should call Close when done.
+func OpenCollection(filename string) (*CollectionReader, error) {
+	infile, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	ret := NewCollectionReader(infile)
+	ret.closer = infile
+	return ret, nil
+}
+
+// Close closes the underlying file, if the reader was created by
+// OpenCollection. Otherwise it does nothing.
+func (self *CollectionReader) Close() error {
+	if self.closer == nil {
+		return nil
+	}
+	err := self.closer.Close()
+	self.closer = nil
+	return err
+}
+
+// Decoder returns the underlying decoder, which can be queried for warnings and
+// key rewrites concerning the most recent game.
+func (self *CollectionReader) Decoder() *Decoder {
+	return self.decoder
+}
+
+// Next reads the next game in the collection and returns its root. At the end
+// of the collection, io.EOF is returned. If the previous game was read with
+// NextRoot and neither finished nor skipped, it is skipped.
+func (self *CollectionReader) Next() (*Node, error) {
+	self.Skip()
+	return self.decoder.Decode()
+}
+
+// NextRoot reads only the root node of the next game in the collection. The
+// caller can then call Finish to read the rest of the game, or Skip (or simply
+// call Next or NextRoot again) to discard it unread. At the end of the
+// collection, io.EOF is returned.
+func (self *CollectionReader) NextRoot() (*Node, error) {
+
+	self.Skip()
+
+	self.decoder.warnings = nil
+	self.decoder.rewrites = nil
+
+	root, err := self.decoder.decode(true)
+	if err != nil {
+		return nil, err
+	}
+
+	self.root = root
+	return root, nil
+}
+
+// Finish reads the rest of the game whose root was returned by NextRoot, and
+// returns the root again, now with its whole tree attached.
+func (self *CollectionReader) Finish() (*Node, error) {
+
+	if self.root == nil {
+		return nil, fmt.Errorf("CollectionReader.Finish(): no game root was read")
+	}
+
+	root := self.root
+	self.root = nil
+
+	return self.decoder.finish(root)
+}
+
+// Skip discards the rest of the game whose root was returned by NextRoot. It
+// does nothing if there is no such game.
+func (self *CollectionReader) Skip() {
+	if self.root != nil {
+		self.decoder.skip()
+		self.root = nil
+	}
+}
@@ -0,0 +1,633 @@
+package sgf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// A Decoder reads SGF trees from an input stream. Trees are built up
+// incrementally as bytes arrive, so the input is never held in memory as a
+// whole; this makes it suitable for huge collection files and network bodies.
+type Decoder struct {
+	r				*bufio.Reader
+	err				error			// Sticky read error, usually io.EOF.
+	opts			LoadOptions
+	warnings		[]*ParseError	// Repairs made during the last Decode().
+	rewrites		map[string]string	// Keys changed during the last Decode().
+
+	pos				position
+	prev			position		// Position before the last byte was read, for unread().
+
+	open			bool			// A root-only read stopped partway through its tree.
+	depth			int				// Number of ( consumed in the current tree but not yet closed.
+	tree_ca			string			// The CA property of the tree's root, as read.
+}
+
+type position struct {
+	offset			int64			// Number of bytes read so far.
+	line			int				// Line and column of the last byte read,
+	col				int				// both 1-based. Column counts bytes.
+	last			byte			// The last byte read.
+	newline			bool			// Whether the last byte read was '\n'.
+}
+
+// A ParseError describes a problem found while parsing SGF. It records where in
+// the input the problem was found, and which node was being read at the time.
+type ParseError struct {
+	Offset			int64			// Byte offset of the problem, zeroth-based.
+	Line			int				// Line number, 1-based.
+	Column			int				// Column in bytes, 1-based.
+	Token			string			// The offending input, or "" if the input ended.
+	Path			[]int			// Child indices leading from the root to the node being read; nil if no node.
+	Msg				string
+}
+
+// Error returns the error message, prefixed by the line and column.
+func (self *ParseError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", self.Line, self.Column, self.Msg)
+}
+
+// LoadOptions adjusts the behaviour of the SGF parser. The zero value gives the
+// normal, strict behaviour.
+type LoadOptions struct {
+
+	// If Recover is set, damaged input does not cause failure. Instead, bytes
+	// that cannot be parsed are skipped, unbalanced brackets are closed, values
+	// with no key are dropped, and the best-effort tree is returned. Each such
+	// repair is described by a warning.
+
+	Recover			bool
+
+	// Unless RawCharset is set, values are converted to UTF-8 according to the
+	// root's CA property, provided the charset is known (see RegisterCharset).
+	// Charsets supplied here are used in preference to registered ones.
+
+	RawCharset		bool
+	Charsets		map[string]Charset
+
+	// Keys determines how property names containing lowercase letters (as
+	// found in FF[1] to FF[3] files) are treated. Names that were changed can
+	// be retrieved from Decoder.KeyRewrites().
+
+	Keys			KeyMode
+
+	// If ExpandPoints is set, SGF rectangles in point lists (e.g. "dd:fg" in
+	// an AB property) are replaced by the single points they represent.
+
+	ExpandPoints	bool
+}
+
+// NewDecoder returns a new decoder that reads from r. The decoder introduces
+// its own buffering and may read data from r beyond the SGF trees requested.
+func NewDecoder(r io.Reader) *Decoder {
+	return NewDecoderOptions(r, LoadOptions{})
+}
+
+// NewDecoderOptions is like NewDecoder, but the parser's behaviour is adjusted
+// by the given options.
+func NewDecoderOptions(r io.Reader, opts LoadOptions) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), pos: position{line: 1}, opts: opts}
+}
+
+// Warnings returns a description of each repair made to the input during the
+// most recent call to Decode. Only a decoder with the Recover option set makes
+// repairs.
+func (self *Decoder) Warnings() []*ParseError {
+	var ret []*ParseError
+	for _, w := range self.warnings {
+		ret = append(ret, w)
+	}
+	return ret
+}
+
+// InputOffset returns the number of bytes of input consumed so far.
+func (self *Decoder) InputOffset() int64 {
+	return self.pos.offset
+}
+
+// Decode reads the next SGF tree from the input and returns its root. When the
+// input contains nothing but whitespace before its end, io.EOF is returned. As
+// with the other loaders, a tree cut off by the end of input (e.g. lacking its
+// final ")" character) is returned as far as it goes.
+func (self *Decoder) Decode() (*Node, error) {
+	self.warnings = nil
+	self.rewrites = nil
+	return self.decode(false)
+}
+
+// decode reads the next tree, or if root_only is set, just its root node - in
+// which case the decoder may be left partway through the tree, and the open
+// flag is set.
+func (self *Decoder) decode(root_only bool) (*Node, error) {
+
+	self.open = false
+
+	for {
+
+		for {
+			c, ok := self.next()
+			if ok == false {
+				if self.err == io.EOF {
+					return nil, io.EOF
+				}
+				return nil, self.err
+			}
+			if c <= ' ' {						// Reasonable definition of whitespace, where ' ' is byte 32.
+				continue
+			} else if c == '(' {
+				self.depth = 1
+				break
+			} else if self.opts.Recover {
+				self.warn(self.error_at_last(nil, "skipped unexpected byte 0x%x before (", c))
+			} else {
+				return nil, self.error_at_last(nil, "unexpected byte 0x%x before (", c)
+			}
+		}
+
+		root, err := self.read_tree(nil, nil, root_only)
+
+		if err == nil && self.err != nil && self.err != io.EOF {
+			return nil, self.err				// A genuine I/O problem, not just the end of input.
+		}
+
+		if root == nil && err == nil {
+			continue							// Recovery mode dropped an empty tree. Try the next one.
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		self.tree_ca, _ = root.GetValue("CA")
+
+		if self.has_postprocessing() {
+			nodes := []*Node{root}
+			if self.open == false {
+				nodes = subtree_nodes(root)
+			}
+			err = self.postprocess(nodes)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return root, nil
+	}
+}
+
+// finish reads the rest of a tree whose root was read by decode(true).
+func (self *Decoder) finish(root *Node) (*Node, error) {
+
+	if self.open == false {
+		return root, nil
+	}
+
+	self.open = false
+
+	// The root may have been read from inside merged subtrees (in recovery mode),
+	// in which case each enclosing level is resumed in turn, just as read_tree()
+	// would have carried on with the merged subtree's root as its node...
+
+	for self.depth > 0 {
+
+		_, err := self.read_tree(nil, root, false)
+
+		if err == nil && self.err != nil && self.err != io.EOF {
+			return nil, self.err
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if self.err != nil {
+			break								// End of input, without closing every level.
+		}
+	}
+
+	if self.has_postprocessing() {
+		err := self.postprocess(subtree_nodes(root)[1:])		// Root was already done.
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return root, nil
+}
+
+// skip discards the rest of a tree whose root was read by decode(true). The
+// read may have stopped inside a nested subtree (in recovery mode), so the
+// depth reached by read_tree() is used to find the tree's end.
+func (self *Decoder) skip() {
+
+	if self.open == false {
+		return
+	}
+
+	self.open = false
+
+	inside_value := false
+
+	for self.depth > 0 {
+		c, ok := self.next()
+		if ok == false {
+			return
+		}
+		if inside_value {
+			if c == '\\' {
+				self.next()
+			} else if c == ']' {
+				inside_value = false
+			}
+		} else {
+			if c == '[' {
+				inside_value = true
+			} else if c == '(' {
+				self.depth++
+			} else if c == ')' {
+				self.depth--
+			}
+		}
+	}
+}
+
+// has_postprocessing returns whether postprocess() has anything to do for the
+// current tree, so that the nodes need not be gathered otherwise.
+func (self *Decoder) has_postprocessing() bool {
+	if self.opts.ExpandPoints {
+		return true
+	}
+	if self.opts.RawCharset {
+		return false
+	}
+	_, ok := transcoding_charset(self.tree_ca, self.opts.Charsets)
+	return ok
+}
+
+// subtree_nodes is like Node.SubtreeNodes, but without recursion, which would be
+// slow (and deep) for long lines.
+func subtree_nodes(root *Node) []*Node {
+
+	var ret []*Node
+	stack := []*Node{root}
+
+	for len(stack) > 0 {
+		node := stack[len(stack) - 1]
+		stack = stack[:len(stack) - 1]
+		ret = append(ret, node)
+		for i := len(node.children) - 1; i >= 0; i-- {		// Reversed, so the first child is popped first.
+			stack = append(stack, node.children[i])
+		}
+	}
+
+	return ret
+}
+
+// postprocess applies the options which act on finished nodes. The nodes are
+// either a whole tree, or part of one, starting with its root.
+func (self *Decoder) postprocess(nodes []*Node) error {
+
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	if self.opts.ExpandPoints {
+		size := nodes[0].RootBoardSize()
+		for _, node := range nodes {
+			expand_point_lists(node, size)
+		}
+	}
+
+	return self.transcode(nodes)
+}
+
+func (self *Decoder) transcode(nodes []*Node) error {
+
+	if self.opts.RawCharset {
+		return nil
+	}
+
+	failures, changed, err := transcode_nodes(nodes, self.tree_ca, self.opts.Charsets, self.opts.Recover)
+	if err != nil {
+		return err
+	}
+
+	if failures > 0 {
+		self.warn(self.error_at_end(nodes[0], "left %d values undecodable by the CA charset as they were", failures))
+	}
+
+	if changed {
+		declare_utf8(nodes[0].GetRoot())
+	}
+
+	return nil
+}
+
+// LoadReader reads an SGF tree from an io.Reader, creating a tree of SGF nodes,
+// and returns the root. If the input has more than one SGF tree only the first
+// is loaded - use a Decoder for such input instead.
+func LoadReader(r io.Reader) (*Node, error) {
+	root, _, err := LoadReaderOptions(r, LoadOptions{})
+	return root, err
+}
+
+// LoadReaderOptions is like LoadReader, but the parser's behaviour is adjusted
+// by the given options. Any repairs made to the input are returned as warnings.
+func LoadReaderOptions(r io.Reader, opts LoadOptions) (*Node, []*ParseError, error) {
+	decoder := NewDecoderOptions(r, opts)
+	root, err := decoder.Decode()
+	if err == io.EOF {
+		return nil, decoder.Warnings(), fmt.Errorf("LoadReader(): no SGF tree found")
+	}
+	return root, decoder.Warnings(), err
+}
+
+func (self *Decoder) next() (byte, bool) {
+	if self.err != nil {
+		return 0, false
+	}
+	c, err := self.r.ReadByte()
+	if err != nil {
+		self.err = err
+		return 0, false
+	}
+	self.prev = self.pos
+	self.pos.offset++
+	if self.pos.newline {
+		self.pos.line++
+		self.pos.col = 1
+	} else {
+		self.pos.col++
+	}
+	self.pos.last = c
+	self.pos.newline = (c == '\n')
+	return c, true
+}
+
+// unread puts back the last byte read. It can only be called once between
+// calls to next().
+func (self *Decoder) unread() {
+	self.r.UnreadByte()
+	self.pos = self.prev
+}
+
+// error_at_last returns a ParseError located at the last byte read, which is
+// taken to be the offending token.
+func (self *Decoder) error_at_last(node *Node, format string, args ...interface{}) *ParseError {
+	var token string
+	if self.pos.offset > 0 {
+		token = byte_to_string(self.pos.last)
+	}
+	return &ParseError{
+		Offset: self.pos.offset - 1,
+		Line: self.pos.line,
+		Column: self.pos.col,
+		Token: token,
+		Path: node_path(node),
+		Msg: fmt.Sprintf(format, args...),
+	}
+}
+
+// error_at_end returns a ParseError located just past the last byte read, for
+// problems caused by the input ending.
+func (self *Decoder) error_at_end(node *Node, format string, args ...interface{}) *ParseError {
+	line, col := self.pos.line, self.pos.col + 1
+	if self.pos.newline {
+		line, col = self.pos.line + 1, 1
+	}
+	return &ParseError{
+		Offset: self.pos.offset,
+		Line: line,
+		Column: col,
+		Path: node_path(node),
+		Msg: fmt.Sprintf(format, args...),
+	}
+}
+
+func (self *Decoder) warn(w *ParseError) {
+	self.warnings = append(self.warnings, w)
+}
+
+func node_path(node *Node) []int {
+
+	var ret []int
+
+	for node != nil && node.parent != nil {
+		for i, sibling := range node.parent.children {
+			if sibling == node {
+				ret = append(ret, i)
+				break
+			}
+		}
+		node = node.parent
+	}
+
+	if node == nil {
+		return nil
+	}
+
+	if ret == nil {
+		ret = []int{}					// The root itself; distinct from nil, which means no node at all.
+	}
+
+	// Reverse the slice...
+
+	for left, right := 0, len(ret) - 1; left < right; left, right = left + 1, right - 1 {
+		ret[left], ret[right] = ret[right], ret[left]
+	}
+
+	return ret
+}
+
+func (self *Decoder) read_tree(parent_of_local_root *Node, resume *Node, root_only bool) (*Node, error) {
+
+	// A tree is whatever is between ( and ) - the opening ( has already been
+	// consumed by the caller.
+	//
+	// If root_only is set, reading stops (setting the open flag) just before
+	// the start of the second node or of any subtree. Reading can be restarted
+	// by passing the root read as resume.
+	//
+	// In recovery mode, a nil root with a nil error can be returned, meaning the
+	// tree was empty and has been dropped.
+	//
+	// FIXME: this is not unicode aware. Potential problems exist if
+	// a unicode code point contains a meaningful character, especially
+	// the bytes ] and \ although this is impossible for utf-8.
+
+	var root *Node
+	var node *Node
+	var inside_value bool
+	var orphan_value bool						// Recovery mode: value has no key, and will be dropped.
+	var value bytes.Buffer						// I used to use string and += string(c), but
+	var key bytes.Buffer						// ran into https://play.golang.org/p/435YV7klTuI
+	var keycomplete bool
+	var raw_key bytes.Buffer					// The key including any lowercase letters.
+	var raw_complete bool
+	var eff_key string							// The key values are actually stored under.
+
+	if resume != nil {
+		root = resume
+		node = resume
+	}
+
+	for {
+
+		c, ok := self.next()
+		if ok == false {
+			break
+		}
+
+		if inside_value {
+
+			if c == '\\' {
+				escaped, ok := self.next()
+				if ok == false {
+					if self.opts.Recover == false {
+						return nil, self.error_at_end(node, "escape character at end of input")
+					}
+					self.warn(self.error_at_end(node, "dropped escape character at end of input"))
+					break
+				}
+				value.WriteByte(escaped)
+			} else if c == ']' {
+				inside_value = false
+				if node == nil {
+					return nil, self.error_at_last(node, "value ended by ] but node was nil")
+				}
+				if orphan_value == false {
+					node.AddValue(eff_key, value.String())
+				}
+			} else {
+				value.WriteByte(c)
+			}
+
+		} else {
+
+			if c <= ' ' {
+				continue											// Silently discard whitespace
+			} else if c >= 'a' && c <= 'z' {
+				if raw_complete {									// Lowercase ASCII is only kept in the raw key,
+					raw_key.Reset()									// which is ignored by default.
+					raw_complete = false
+				}
+				raw_key.WriteByte(c)
+			} else if c == '[' {
+				if node == nil {
+					// The tree has ( but no ; before its first property. We could return an error.
+					// Alternatively, we can tolerate this...
+					node = NewNode(parent_of_local_root)
+					root = node										// First node we saw in the tree.
+				}
+				value.Reset()
+				inside_value = true
+				if keycomplete == false {							// Only if a key began; lowercase between values,
+					eff_key = self.effective_key(key.String(), raw_key.String())
+				}													// e.g. AB[aa]foo[bb], doesn't start one.
+				keycomplete = true
+				raw_complete = true
+				orphan_value = false
+				if eff_key == "" {
+					if self.opts.Recover == false {
+						return nil, self.error_at_last(node, "value started with [ but key was \"\"")
+					}
+					self.warn(self.error_at_last(node, "dropped value with no key"))
+					orphan_value = true
+				}
+			} else if c == '(' {
+				if root_only && node != nil {
+					self.unread()
+					self.open = true
+					return root, nil
+				}
+				if node == nil {
+					if self.opts.Recover == false {
+						return nil, self.error_at_last(parent_of_local_root, "new subtree started but node was nil")
+					}
+					self.warn(self.error_at_last(parent_of_local_root, "merged subtree started before any node"))
+					self.depth++
+					sub, err := self.read_tree(parent_of_local_root, nil, root_only)
+					if err != nil {
+						return nil, err
+					}
+					if sub != nil {
+						node = sub
+						root = sub
+					}
+					continue
+				}
+				self.depth++
+				_, err := self.read_tree(node, nil, false)
+				if err != nil {
+					return nil, err
+				}
+			} else if c == ')' {
+				self.depth--
+				if root == nil {
+					if self.opts.Recover == false {
+						return nil, self.error_at_last(parent_of_local_root, "subtree ended but local root was nil")
+					}
+					self.warn(self.error_at_last(parent_of_local_root, "dropped empty subtree"))
+					return nil, nil
+				}
+				return root, nil
+			} else if c == ';' {
+				if root_only && node != nil {
+					self.unread()
+					self.open = true
+					return root, nil
+				}
+				if node == nil {
+					node = NewNode(parent_of_local_root)
+					root = node										// First node we saw in the tree.
+				} else {
+					node = NewNode(node)
+				}
+				key.Reset()
+				keycomplete = false
+				raw_key.Reset()
+				raw_complete = false
+			} else if c >= 'A' && c <= 'Z' {
+				if keycomplete {
+					key.Reset()
+					keycomplete = false
+				}
+				key.WriteByte(c)
+				if raw_complete {
+					raw_key.Reset()
+					raw_complete = false
+				}
+				raw_key.WriteByte(c)
+			} else {
+				if self.opts.Recover == false {
+					return nil, self.error_at_last(node, "unacceptable byte 0x%x while expecting key", c)
+				}
+				self.warn(self.error_at_last(node, "skipped unacceptable byte 0x%x while expecting key", c))
+			}
+		}
+	}
+
+	// Just being here must mean we reached the actual end of the input without
+	// reading a final ')' character. Still, we can return what we have.
+	// Note that load_special() relies on this.
+
+	if self.opts.Recover {
+		if inside_value && orphan_value == false && node != nil {
+			self.warn(self.error_at_end(node, "closed unterminated value at end of input"))
+			node.AddValue(eff_key, value.String())
+		}
+		if root == nil {
+			self.warn(self.error_at_end(parent_of_local_root, "dropped empty subtree at end of input"))
+			return nil, nil
+		}
+		self.warn(self.error_at_end(node, "closed unbalanced ( at end of input"))
+	}
+
+	if root == nil {
+		return nil, self.error_at_end(parent_of_local_root, "local root was nil at end of input")
+	}
+
+	return root, nil
+}
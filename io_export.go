@@ -0,0 +1,145 @@
+package sgf
+
+// Helpers for the writers of formats which can only hold a single line of play
+// (e.g. GIB and NGF), with no variations, comments, or mid-game setup.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type line_move struct {
+	colour			Colour
+	x				int
+	y				int
+}
+
+// export_line returns the root, the handicap stones (i.e. the root's AB), and
+// the moves of the line of play through the node: its ancestors, then the main
+// line onwards. Passes are skipped, since the formats have no way to record
+// them. An error is returned if the line has any setup other than the root's
+// black stones.
+func export_line(node *Node) (root *Node, handicap []string, moves []line_move, err error) {
+
+	line := full_line(node)
+
+	root = line[0]
+	size := root.RootBoardSize()
+
+	for _, value := range root.AllValues("AB") {
+		if points := ParsePointList(value, size); points != nil {
+			handicap = append(handicap, points...)
+		} else {
+			handicap = append(handicap, value)
+		}
+	}
+
+	for i, node := range line {
+
+		for _, key := range []string{"AB", "AW", "AE"} {
+			if (i > 0 || key != "AB") && node.ValueCount(key) > 0 {
+				return nil, nil, nil, fmt.Errorf("export_line(): can't represent %s property", key)
+			}
+		}
+
+		for _, key := range []string{"B", "W"} {
+			value, ok := node.GetValue(key)
+			if ok == false {
+				continue
+			}
+			x, y, onboard := ParsePoint(value, size)
+			if onboard {
+				colour := BLACK; if key == "W" { colour = WHITE }
+				moves = append(moves, line_move{colour, x, y})
+			}
+		}
+	}
+
+	return root, handicap, moves, nil
+}
+
+// full_line returns the line of play through the node: its ancestors, then the
+// main line onwards.
+func full_line(node *Node) []*Node {
+	line := node.GetLine()
+	for node.MainChild() != nil {
+		node = node.MainChild()
+		line = append(line, node)
+	}
+	return line
+}
+
+// is_tygem_handicap returns true if the stones are exactly the standard Tygem
+// layout for that number of handicap stones.
+func is_tygem_handicap(stones []string, size int) bool {
+
+	expected := HandicapPoints(size, len(stones), true)
+	if len(expected) != len(stones) {
+		return false
+	}
+
+	a := append([]string(nil), stones...)
+	b := append([]string(nil), expected...)
+	sort.Strings(a)
+	sort.Strings(b)
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// split_result splits an RE value into the winner and the margin, which is
+// "R" or "T" or "F", a number of points, or "" if none was given. The winner is
+// EMPTY if the value is not of that form (e.g. a draw).
+func split_result(re string) (winner Colour, margin string) {
+
+	re = strings.ToUpper(strings.TrimSpace(re))
+
+	if strings.HasPrefix(re, "B+") {
+		winner = BLACK
+	} else if strings.HasPrefix(re, "W+") {
+		winner = WHITE
+	} else {
+		return EMPTY, ""
+	}
+
+	margin = re[2:]
+
+	switch margin {
+	case "", "R", "T", "F":
+		return winner, margin
+	case "RESIGN":
+		return winner, "R"
+	case "TIME":
+		return winner, "T"
+	case "FORFEIT":
+		return winner, "F"
+	}
+
+	if points, err := strconv.ParseFloat(margin, 64); err == nil && points > 0 && math.IsInf(points, 0) == false {
+		return winner, margin
+	}
+
+	return EMPTY, ""
+}
+
+// one_line returns the value with line breaks replaced by spaces, for use in
+// line-based formats.
+func one_line(s string) string {
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == '\r' }), " ")
+}
+
+func write_string_to(s string) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := io.WriteString(w, s)
+		return err
+	}
+}
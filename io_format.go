@@ -0,0 +1,133 @@
+package sgf
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A Format is a file format for game records, as recognised by DetectFormat.
+type Format int8
+
+const (
+	UNKNOWN_FORMAT = Format(iota)
+	SGF_FORMAT
+	GIB_FORMAT							// Tygem
+	NGF_FORMAT							// WBaduk
+	UGF_FORMAT							// PandaNet / Igowin, including UGI
+	JSON_FORMAT							// OGS
+	NODE_JSON_FORMAT					// This library's own, see Node.MarshalJSON
+)
+
+// String returns the usual file extension for the format, without the dot, or
+// "unknown".
+func (self Format) String() string {
+	switch self {
+	case SGF_FORMAT:
+		return "sgf"
+	case GIB_FORMAT:
+		return "gib"
+	case NGF_FORMAT:
+		return "ngf"
+	case UGF_FORMAT:
+		return "ugf"
+	case JSON_FORMAT, NODE_JSON_FORMAT:
+		return "json"
+	}
+	return "unknown"
+}
+
+// DetectFormat examines the start of a file's contents (a few KB is plenty) and
+// returns its format, or UNKNOWN_FORMAT if it isn't recognised. The extension of
+// the file is not needed, which is the point.
+func DetectFormat(data []byte) Format {
+
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))		// UTF-8 BOM
+	data = bytes.TrimSpace(data)
+
+	if len(data) == 0 {
+		return UNKNOWN_FORMAT
+	}
+
+	// The unambiguous cases first...
+
+	if data[0] == '(' && bytes.HasPrefix(bytes.TrimLeft(data[1:], " \t\r\n"), []byte(";")) {
+		return SGF_FORMAT
+	}
+
+	if data[0] == '{' {
+		return json_format(data)
+	}
+
+	if bytes.HasPrefix(data, []byte("\\HS")) || bytes.Contains(data, []byte("\\[GIBOKIND=")) {
+		return GIB_FORMAT
+	}
+
+	lines := strings.Split(string(data), "\n")
+
+	for _, line := range lines {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line == "[header]" || line == "[data]" || line == "[figure]" {
+			return UGF_FORMAT
+		}
+	}
+
+	// NGF has no marker, but the 2nd line is the board size, the 12th is the
+	// number of moves, and moves start with "PM"...
+
+	if len(lines) >= 12 {
+		size, err1 := strconv.Atoi(strings.TrimSpace(lines[1]))
+		_, err2 := strconv.Atoi(strings.TrimSpace(lines[11]))
+		if err1 == nil && err2 == nil && size >= 1 && size <= 52 {
+			if len(lines) == 12 || strings.HasPrefix(strings.ToUpper(strings.TrimSpace(lines[12])), "PM") {
+				return NGF_FORMAT
+			}
+		}
+	}
+
+	// SGF files sometimes have junk before the game, e.g. email headers...
+
+	if bytes.Contains(data, []byte("(;")) {
+		return SGF_FORMAT
+	}
+
+	return UNKNOWN_FORMAT
+}
+
+// json_format distinguishes this library's node JSON, which always starts with
+// the "nodes" key, from OGS JSON. The data may be truncated, so it can't simply
+// be unmarshalled.
+func json_format(data []byte) Format {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := decoder.Token(); err != nil || tok != json.Delim('{') {
+		return UNKNOWN_FORMAT
+	}
+	tok, err := decoder.Token()
+	if err != nil {
+		return UNKNOWN_FORMAT
+	}
+	if tok == "nodes" || tok == "variations" {
+		return NODE_JSON_FORMAT
+	}
+	return JSON_FORMAT
+}
+
+// format_from_extension returns the format implied by the filename's extension,
+// or UNKNOWN_FORMAT.
+func format_from_extension(filename string) Format {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".sgf":
+		return SGF_FORMAT
+	case ".gib":
+		return GIB_FORMAT
+	case ".ngf":
+		return NGF_FORMAT
+	case ".ugf", ".ugi":
+		return UGF_FORMAT
+	case ".json":
+		return JSON_FORMAT
+	}
+	return UNKNOWN_FORMAT
+}
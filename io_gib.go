@@ -1,19 +1,55 @@
 package sgf
 
-// Basic GIB parser (i.e. for Tygem files)
+// GIB parser and writer (i.e. for Tygem files)
+//
+// Header lines look like \[KEY=VALUE\] and are all optional. Those used are:
+//
+//		GAMEBLACKNAME, GAMEWHITENAME		Name, usually with rank in brackets, e.g. "foo (5K)" or "foo (9단)"
+//		GAMEBLACKNICK, GAMEWHITENICK		Used for the name if the above is missing
+//		GAMETAG								Date, result and komi, see parse_gib_gametag()
+//		GAMEDATE							Date, if GAMETAG has none, e.g. "2017- 3-16- 2-52-45"
+//		GAMEINFOMAIN						Time settings in its GTIME field, e.g. "GTIME:1800-30-3", and
+//											result and komi (GRLT, ZIPSU, GONGJE), if GAMETAG has none
+//		GAMENAME, GAMEPLACE					Event and place
+//		GAMELECNAME, GAMECOMMENT			Commentator and game comment
+//		GAMEBOARDSIZE, GAMERULE				Board size and rules, where present
+//
+// The handicap comes from the INI line. If Black's first moves are exactly the
+// handicap stones, the players chose the placement and those moves become AB;
+// otherwise the standard Tygem layout is used.
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 // LoadGIB parses a GIB string, creating a tree of SGF nodes, and returns the
-// root.
+// root. The string is used as it is; see LoadGIBOptions for files which are not
+// UTF-8.
 func LoadGIB(gib string) (*Node, error) {
+	return load_gib(gib)
+}
 
-	root := NewTree(19)
-	node := root
+// LoadGIBOptions is like LoadGIB, but unless opts.RawCharset is set, input that
+// is not valid UTF-8 is first decoded as Korean (CP949 or EUC-KR) or Chinese
+// (GBK, GB18030 or GB2312), as Tygem files usually are. The first of these which
+// is supplied in opts.Charsets, or failing that registered (see RegisterCharset),
+// and which decodes the input is used, and the root is given CA[UTF-8]. If they
+// all fail, an error is returned, unless opts.Recover is set, in which case the
+// input is used as it is.
+func LoadGIBOptions(gib string, opts LoadOptions) (*Node, error) {
+	return load_import(gib, []string{"CP949", "EUC-KR", "GBK", "GB18030", "GB2312"}, opts, load_gib)
+}
+
+func load_gib(gib string) (*Node, error) {
+
+	header := make(map[string]string)
+	handicap := 0
+	var moves [][3]int				// colour, x, y
 
 	lines := strings.Split(gib, "\n")
 
@@ -21,23 +57,9 @@ func LoadGIB(gib string) (*Node, error) {
 
 		line = strings.TrimSpace(line)
 
-		// Names...
-
-		if strings.HasPrefix(line, "\\[GAMEBLACKNAME=") && strings.HasSuffix(line, "\\]") {
-			root.SetValue("PB", line[16: len(line) - 2])
-		}
-
-		if strings.HasPrefix(line, "\\[GAMEWHITENAME=") && strings.HasSuffix(line, "\\]") {
-			root.SetValue("PW", line[16: len(line) - 2])
-		}
-
-		// Game info...
-
-		if strings.HasPrefix(line, "\\[GAMETAG=") {
-			dt, re, km := parse_gib_gametag(line)
-			if dt != "" { root.SetValue("DT", dt) }
-			if re != "" { root.SetValue("RE", re) }
-			if km != "" { root.SetValue("KM", km) }
+		if key, val, ok := parse_gib_header(line); ok {
+			header[key] = val
+			continue
 		}
 
 		// Split the line into tokens for the handicap and move parsing...
@@ -48,39 +70,253 @@ func LoadGIB(gib string) (*Node, error) {
 
 		if len(fields) >= 4 && fields[0] == "INI" {
 
-			if node != root {
+			if len(moves) > 0 {
 				return nil, fmt.Errorf("load_gib(): got INI field after moves were made")
 			}
 
-			handicap, _ := strconv.Atoi(fields[3])
-
-			if handicap > 1 {
-				root.SetValue("HA", strconv.Itoa(handicap))
-				root.SetValues("AB", HandicapPoints(19, handicap, true))
-			}
+			handicap, _ = strconv.Atoi(fields[3])
 		}
 
 		// Moves...
 
 		if len(fields) >= 6 && fields[0] == "STO" {
+			colour, err0 := strconv.Atoi(fields[3])
 			x, err1 := strconv.Atoi(fields[4])
 			y, err2 := strconv.Atoi(fields[5])
-			if err1 == nil && err2 == nil {
-				key := "B"; if fields[3] == "2" { key = "W" }
-				node = NewNode(node)
-				node.SetValue(key, Point(x, y))
+			if err0 == nil && err1 == nil && err2 == nil {
+				moves = append(moves, [3]int{colour, x, y})
 			}
 		}
 	}
 
+	size := 19
+	if sz, err := strconv.Atoi(header["GAMEBOARDSIZE"]); err == nil && sz >= 1 && sz <= 52 {
+		size = sz
+	}
+
+	root := NewTree(size)
+	node := root
+
+	// Players...
+
+	for _, colour := range []string{"BLACK", "WHITE"} {
+		name, rank := split_gib_name(header["GAME" + colour + "NAME"])
+		if name == "" {
+			name = header["GAME" + colour + "NICK"]
+		}
+		if name != "" { root.SetValue("P" + colour[0:1], name) }
+		if rank != "" { root.SetValue(colour[0:1] + "R", rank) }
+	}
+
+	// Game info...
+
+	if line, ok := header["GAMETAG"]; ok {
+		dt, re, km := parse_gib_gametag(line)
+		if dt != "" { root.SetValue("DT", dt) }
+		if re != "" { root.SetValue("RE", re) }
+		if km != "" { root.SetValue("KM", km) }
+	}
+
+	re, km := parse_gib_infomain(header["GAMEINFOMAIN"])
+	if _, ok := root.GetValue("RE"); ok == false && re != "" { root.SetValue("RE", re) }
+	if _, ok := root.GetValue("KM"); ok == false && km != "" { root.SetValue("KM", km) }
+
+	if _, ok := root.GetValue("DT"); ok == false {
+		if dt := parse_gib_date(header["GAMEDATE"]); dt != "" {
+			root.SetValue("DT", dt)
+		}
+	}
+
+	tm, ot := parse_gib_time(header["GAMEINFOMAIN"])
+	if tm != "" { root.SetValue("TM", tm) }
+	if ot != "" { root.SetValue("OT", ot) }
+
+	if ru := parse_gib_rules(header["GAMERULE"]); ru != "" {
+		root.SetValue("RU", ru)
+	}
+
+	for _, item := range [][2]string{{"GAMENAME", "EV"}, {"GAMEPLACE", "PC"}, {"GAMELECNAME", "AN"}, {"GAMECOMMENT", "GC"}} {
+		if val := strings.TrimSpace(header[item[0]]); val != "" {
+			root.SetValue(item[1], val)
+		}
+	}
+
+	// Handicap...
+
+	if handicap > 1 {
+
+		root.SetValue("HA", strconv.Itoa(handicap))
+
+		free_placement := len(moves) >= handicap
+		for n := 0; n < handicap && n < len(moves); n++ {
+			if moves[n][0] != 1 {
+				free_placement = false
+			}
+		}
+
+		if free_placement {
+			for _, mv := range moves[:handicap] {
+				root.AddValue("AB", Point(mv[1], mv[2]))
+			}
+			moves = moves[handicap:]
+		} else {
+			root.SetValues("AB", HandicapPoints(size, handicap, true))
+		}
+	}
+
+	// Moves...
+
+	for _, mv := range moves {
+		if mv[1] < 0 || mv[1] >= size || mv[2] < 0 || mv[2] >= size {
+			continue
+		}
+		key := "B"; if mv[0] == 2 { key = "W" }
+		node = NewNode(node)
+		node.SetValue(key, Point(mv[1], mv[2]))
+	}
+
 	return root, nil
 }
 
+func parse_gib_header(line string) (key, val string, ok bool) {
+
+	if strings.HasPrefix(line, "\\[") == false || strings.HasSuffix(line, "\\]") == false {
+		return "", "", false
+	}
+
+	eq := strings.Index(line, "=")
+	if eq == -1 || eq > len(line) - 2 {
+		return "", "", false
+	}
+
+	return line[2:eq], line[eq + 1: len(line) - 2], true
+}
+
+// split_gib_name splits a name like "foo (5K)" into the name and an SGF rank,
+// e.g. "5k". Korean and Chinese rank words are understood.
+func split_gib_name(s string) (name, rank string) {
+
+	s = strings.TrimSpace(s)
+
+	if strings.HasSuffix(s, ")") == false {
+		return s, ""
+	}
+
+	open := strings.LastIndex(s, "(")
+	if open == -1 {
+		return s, ""
+	}
+
+	rank = normalise_gib_rank(s[open + 1: len(s) - 1])
+	if rank == "" {
+		return s, ""
+	}
+
+	return strings.TrimSpace(s[:open]), rank
+}
+
+func normalise_gib_rank(s string) string {
+
+	s = strings.TrimSpace(s)
+
+	digits := strings.IndexFunc(s, func(r rune) bool { return unicode.IsDigit(r) == false })
+	if digits <= 0 {
+		return ""
+	}
+
+	n, unit := s[:digits], strings.TrimSpace(s[digits:])
+
+	switch strings.ToLower(unit) {
+	case "k", "kyu", "급", "级", "級":
+		return n + "k"
+	case "d", "dan", "단", "段":
+		return n + "d"
+	case "p", "pro", "프로", "职业", "職業":
+		return n + "p"
+	}
+
+	return ""
+}
+
+func parse_gib_date(s string) string {
+
+	// e.g. "2017- 3-16- 2-52-45"
+
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == '-' || r == ' ' || r == ':' || r == '/' })
+	if len(fields) < 3 {
+		return ""
+	}
+
+	y, err1 := strconv.Atoi(fields[0])
+	m, err2 := strconv.Atoi(fields[1])
+	d, err3 := strconv.Atoi(fields[2])
+
+	if err1 != nil || err2 != nil || err3 != nil || m < 1 || m > 12 || d < 1 || d > 31 {
+		return ""
+	}
+
+	return fmt.Sprintf("%04d-%02d-%02d", y, m, d)
+}
+
+func parse_gib_time(infomain string) (tm, ot string) {
+
+	// The GTIME field of GAMEINFOMAIN is main time in seconds, byo-yomi period
+	// in seconds, and number of periods, e.g. "GTIME:1800-30-3".
+
+	for _, item := range strings.Split(infomain, ",") {
+
+		if strings.HasPrefix(item, "GTIME:") == false {
+			continue
+		}
+
+		parts := strings.Split(item[6:], "-")
+		if len(parts) != 3 {
+			return "", ""
+		}
+
+		main, err1 := strconv.Atoi(parts[0])
+		period, err2 := strconv.Atoi(parts[1])
+		count, err3 := strconv.Atoi(parts[2])
+
+		if err1 != nil || err2 != nil || err3 != nil {
+			return "", ""
+		}
+
+		tm = strconv.Itoa(main)
+		if period > 0 && count > 0 {
+			ot = fmt.Sprintf("%dx%d byo-yomi", count, period)
+		}
+		return tm, ot
+	}
+
+	return "", ""
+}
+
+func parse_gib_rules(original string) string {
+
+	original = strings.TrimSpace(original)
+	s := strings.ToLower(original)
+
+	switch {
+	case s == "":
+		return ""
+	case strings.Contains(s, "korea") || strings.Contains(s, "한국"):
+		return "Korean"
+	case strings.Contains(s, "china") || strings.Contains(s, "chinese") || strings.Contains(s, "중국") || strings.Contains(s, "中国"):
+		return "Chinese"
+	case strings.Contains(s, "japan") || strings.Contains(s, "일본") || strings.Contains(s, "日本"):
+		return "Japanese"
+	}
+
+	return original
+}
+
 func parse_gib_gametag(line string) (dt, re, km string) {
 
 	fields := strings.Split(line, ",")
 
-	var zipsu int
+	grlt := -1
+	zipsu := 0
 
 	for _, s := range fields {
 
@@ -97,32 +333,14 @@ func parse_gib_gametag(line string) (dt, re, km string) {
 		}
 
 		if s[0] == 'W' {
-			grlt, err := strconv.Atoi(s[1:])
-			if err == nil {
-				switch grlt {
-				case 0:
-					re = "B+"
-				case 1:
-					re = "W+"
-				case 3:
-					re = "B+R"
-				case 4:
-					re = "W+R"
-				case 7:
-					re = "B+T"
-				case 8:
-					re = "W+T"
-				}
+			if n, err := strconv.Atoi(s[1:]); err == nil {
+				grlt = n
 			}
 		}
 
 		if s[0] == 'G' {
-			gongje, err := strconv.Atoi(s[1:])
-			if err == nil {
-				km = fmt.Sprintf("%.1f", float64(gongje) / 10.0)
-				if strings.HasSuffix(km, ".0") {
-					km = km[:len(km) - 2]
-				}
+			if gongje, err := strconv.Atoi(s[1:]); err == nil {
+				km = gib_komi(gongje)
 			}
 		}
 
@@ -131,6 +349,63 @@ func parse_gib_gametag(line string) (dt, re, km string) {
 		}
 	}
 
+	return dt, gib_re(grlt, zipsu), km
+}
+
+// parse_gib_infomain reads the result and komi from the GRLT, ZIPSU and GONGJE
+// fields of GAMEINFOMAIN, which are the same as the W, Z and G fields of
+// GAMETAG, for files without the latter.
+func parse_gib_infomain(infomain string) (re, km string) {
+
+	grlt := -1
+	zipsu := 0
+
+	for _, item := range strings.Split(infomain, ",") {
+
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			continue
+		}
+
+		switch strings.TrimSpace(parts[0]) {
+		case "GRLT":
+			grlt = n
+		case "ZIPSU":
+			zipsu = n
+		case "GONGJE":
+			km = gib_komi(n)
+		}
+	}
+
+	return gib_re(grlt, zipsu), km
+}
+
+// gib_re converts a GIB result code and margin (in tenths of a point) to an RE
+// value, or "" if the code is unknown.
+func gib_re(grlt, zipsu int) string {
+
+	re := ""
+
+	switch grlt {
+	case 0:
+		re = "B+"
+	case 1:
+		re = "W+"
+	case 3:
+		re = "B+R"
+	case 4:
+		re = "W+R"
+	case 7:
+		re = "B+T"
+	case 8:
+		re = "W+T"
+	}
+
 	if re == "B+" || re == "W+" {
 		if zipsu > 0 {
 			re += fmt.Sprintf("%.1f", float64(zipsu) / 10.0)
@@ -140,5 +415,173 @@ func parse_gib_gametag(line string) (dt, re, km string) {
 		}
 	}
 
-	return dt, re, km
+	return re
+}
+
+// gib_komi converts a GIB komi (in tenths of a point) to a KM value.
+func gib_komi(gongje int) string {
+	km := fmt.Sprintf("%.1f", float64(gongje) / 10.0)
+	if strings.HasSuffix(km, ".0") {
+		km = km[:len(km) - 2]
+	}
+	return km
+}
+
+// GIB returns the line of play through the node (i.e. its ancestors, then the
+// main line onwards) in GIB format. Comments, variations and passes are lost.
+// If the root's handicap stones are not in the standard Tygem layout, the file
+// is written as an even game, with the stones as Black's first moves, so the
+// position is right but the handicap (HA) is lost. An error is returned if the
+// line has other setup, which GIB cannot represent.
+func (self *Node) GIB() (string, error) {
+
+	root, handicap, moves, err := export_line(self)
+	if err != nil {
+		return "", err
+	}
+
+	size := root.RootBoardSize()
+
+	if len(handicap) == 1 {
+		return "", fmt.Errorf("GIB(): can't represent a single handicap stone")
+	}
+
+	// Handicap stones not in the Tygem layout become Black's first moves, since
+	// the INI line would have them placed in that layout...
+
+	ini := len(handicap)
+
+	if ini > 0 && is_tygem_handicap(handicap, size) == false {
+		var placement []line_move
+		for _, p := range handicap {
+			x, y, onboard := ParsePoint(p, size)
+			if onboard == false {
+				return "", fmt.Errorf("GIB(): bad handicap stone %q", p)
+			}
+			placement = append(placement, line_move{BLACK, x, y})
+		}
+		moves = append(placement, moves...)
+		ini = 0
+	}
+
+	var buf bytes.Buffer
+
+	header := func(key, val string) {
+		fmt.Fprintf(&buf, "\\[%s=%s\\]\n", key, one_line(val))
+	}
+
+	buf.WriteString("\\HS\n")
+	header("GIBOKIND", "Global")
+
+	for _, colour := range []string{"BLACK", "WHITE"} {
+		name, _ := root.GetValue("P" + colour[0:1])
+		if rank, _ := root.GetValue(colour[0:1] + "R"); rank != "" {
+			name += " (" + strings.ToUpper(rank) + ")"
+		}
+		header("GAME" + colour + "NAME", name)
+	}
+
+	for _, item := range [][2]string{{"GAMENAME", "EV"}, {"GAMEPLACE", "PC"}, {"GAMELECNAME", "AN"}, {"GAMECOMMENT", "GC"}, {"GAMERULE", "RU"}} {
+		if val, ok := root.GetValue(item[1]); ok {
+			header(item[0], val)
+		}
+	}
+
+	if size != 19 {
+		header("GAMEBOARDSIZE", strconv.Itoa(size))
+	}
+
+	// The result, komi and date are in GAMETAG, the time settings in GAMEINFOMAIN.
+
+	var tags []string
+	info := []string{"GBKIND:0", "GTYPE:0", "GCDT:0"}
+
+	if dt, _ := root.GetValue("DT"); len(dt) >= 10 {
+		if date := parse_gib_date(dt[:10]); date != "" {
+			tags = append(tags, "C" + strings.Replace(date, "-", ":", -1) + ":00:00")
+		}
+	}
+
+	if re, ok := root.GetValue("RE"); ok {
+		if grlt, zipsu, ok := gib_result(re); ok {
+			tags = append(tags, fmt.Sprintf("W%d", grlt), fmt.Sprintf("Z%d", zipsu))
+			info = append(info, fmt.Sprintf("GRLT:%d", grlt), fmt.Sprintf("ZIPSU:%d", zipsu))
+		}
+	}
+
+	if _, ok := root.GetValue("KM"); ok {
+		gongje := int(math.Round(root.RootKomi() * 10))
+		tags = append(tags, fmt.Sprintf("G%d", gongje))
+		info = append(info, fmt.Sprintf("GONGJE:%d", gongje))
+	}
+
+	if tm, ok := root.GetValue("TM"); ok {
+		if main, err := strconv.ParseFloat(tm, 64); err == nil {
+			var count, period int
+			ot, _ := root.GetValue("OT")
+			fmt.Sscanf(ot, "%dx%d", &count, &period)
+			info = append(info, fmt.Sprintf("GTIME:%d-%d-%d", int(main), period, count))
+		}
+	}
+
+	info = append(info, fmt.Sprintf("TCNT:%d", len(moves)))
+
+	header("GAMEINFOMAIN", strings.Join(info, ","))
+	header("GAMETAG", strings.Join(tags, ","))
+
+	buf.WriteString("\\HE\n")
+
+	buf.WriteString("\\GS\n")
+	buf.WriteString("2 1 0\n")
+	fmt.Fprintf(&buf, "%d 0 &4\n", len(moves) + 1)
+	fmt.Fprintf(&buf, "INI 0 1 %d &4\n", ini)
+
+	for i, mv := range moves {
+		colour := 1; if mv.colour == WHITE { colour = 2 }
+		fmt.Fprintf(&buf, "STO 0 %d %d %d %d\n", i + 2, colour, mv.x, mv.y)
+	}
+
+	buf.WriteString("\\GE\n")
+
+	return buf.String(), nil
+}
+
+// SaveGIB saves the line of play through the node to the specified file, in GIB
+// format. See GIB for what is saved. Like Save, saving is atomic.
+func (self *Node) SaveGIB(filename string) error {
+	s, err := self.GIB()
+	if err != nil {
+		return err
+	}
+	return save_atomic(filename, write_string_to(s))
+}
+
+// gib_result converts an RE value to the codes used in GAMETAG, see
+// parse_gib_gametag(). The margin, if any, is in tenths of a point.
+func gib_result(re string) (grlt, zipsu int, ok bool) {
+
+	winner, margin := split_result(re)
+	if winner == EMPTY {
+		return 0, 0, false
+	}
+
+	switch margin {
+	case "R":
+		grlt = 3
+	case "T":
+		grlt = 7
+	case "F":
+		return 0, 0, false
+	default:
+		if margin != "" {
+			points, _ := strconv.ParseFloat(margin, 64)
+			zipsu = int(math.Round(points * 10))
+		}
+	}
+
+	if winner == WHITE {
+		grlt++
+	}
+
+	return grlt, zipsu, true
 }
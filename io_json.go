@@ -0,0 +1,177 @@
+package sgf
+
+// JSON representation of trees. Like SGF, a tree is a sequence of nodes followed
+// by its variations, if any; each node is its properties, in stored order, as
+// arrays of the key followed by the values, e.g.
+//
+//		{"nodes": [[["B", "dd"], ["TR", "cc", "ee"]], [["W", "pp"]]], "variations": [{"nodes": ...}, ...]}
+//
+// So nesting happens only at branch points, and long lines don't run into the
+// nesting limit of encoding/json.
+//
+// Values are stored unescaped, exactly as in memory. Since JSON strings are
+// Unicode, values which are not valid UTF-8 (e.g. from a file loaded with
+// RawCharset) do not survive the round trip.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+type json_tree struct {
+	Nodes			[][][]string		`json:"nodes"`
+	Variations		[]*json_tree		`json:"variations"`
+}
+
+// MarshalJSON returns the node and all its descendants (i.e. the subtree, not
+// the whole tree, unless called on the root) in JSON format. A nil node gives
+// null. This method instantiates json.Marshaler.
+func (self *Node) MarshalJSON() ([]byte, error) {
+
+	if self == nil {
+		return []byte("null"), nil
+	}
+
+	// We write the JSON ourselves rather than have encoding/json recurse
+	// through the tree, which would re-validate the output at every level.
+
+	var buf bytes.Buffer
+	err := write_json_tree(&buf, self)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func write_json_tree(buf *bytes.Buffer, node *Node) error {
+
+	buf.WriteString(`{"nodes":[`)
+
+	for first := true; ; first = false {
+
+		if first == false {
+			buf.WriteByte(',')
+		}
+
+		buf.WriteByte('[')
+		for ki, slice := range node.props {
+			if ki > 0 {
+				buf.WriteByte(',')
+			}
+			b, err := json.Marshal(slice)
+			if err != nil {
+				return err
+			}
+			buf.Write(b)
+		}
+		buf.WriteByte(']')
+
+		if len(node.children) != 1 {
+			break
+		}
+		node = node.children[0]
+	}
+
+	buf.WriteByte(']')
+
+	if len(node.children) > 0 {
+		buf.WriteString(`,"variations":[`)
+		for i, child := range node.children {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := write_json_tree(buf, child)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	}
+
+	buf.WriteByte('}')
+
+	return nil
+}
+
+// UnmarshalJSON replaces the node's properties and children with those in the
+// JSON, as written by MarshalJSON. The node's parent is unchanged; its old
+// children become roots. This method instantiates json.Unmarshaler.
+func (self *Node) UnmarshalJSON(data []byte) error {
+
+	var jt json_tree
+
+	err := json.Unmarshal(data, &jt)
+	if err != nil {
+		return err
+	}
+
+	err = check_json_tree(&jt)
+	if err != nil {
+		return err
+	}
+
+	self.clear_board_cache_recursive()			// Before the children are replaced, as this relies on them.
+
+	for _, child := range self.children {
+		child.parent = nil
+	}
+
+	self.props = nil
+	self.children = nil
+
+	build_json_tree(self, &jt)
+
+	return nil
+}
+
+func check_json_tree(jt *json_tree) error {
+
+	if len(jt.Nodes) == 0 {
+		return fmt.Errorf("Node.UnmarshalJSON(): tree with no nodes")
+	}
+
+	for _, props := range jt.Nodes {
+		seen := make(map[string]bool)
+		for _, slice := range props {
+			if len(slice) < 2 {
+				return fmt.Errorf("Node.UnmarshalJSON(): property with no values")
+			}
+			if slice[0] == "" {
+				return fmt.Errorf("Node.UnmarshalJSON(): empty key")
+			}
+			if seen[slice[0]] {
+				return fmt.Errorf("Node.UnmarshalJSON(): duplicate key %q", slice[0])
+			}
+			seen[slice[0]] = true
+		}
+	}
+
+	for _, variation := range jt.Variations {
+		if variation == nil {
+			return fmt.Errorf("Node.UnmarshalJSON(): null variation")
+		}
+		err := check_json_tree(variation)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// build_json_tree gives the tree's first node's properties to the node, and
+// creates the rest of the tree below it.
+func build_json_tree(node *Node, jt *json_tree) {
+
+	for i, props := range jt.Nodes {
+		if i > 0 {
+			node = NewNode(node)
+		}
+		node.props = props			// Safe to use directly since it's freshly decoded and not shared.
+	}
+
+	for _, variation := range jt.Variations {
+		build_json_tree(NewNode(node), variation)
+	}
+}
@@ -0,0 +1,120 @@
+package sgf
+
+// Handling of old (FF[1] to FF[3]) property names, which may contain lowercase
+// letters, e.g. "AddBlack" or "Comment".
+
+// A KeyMode determines what the loader does with property names that contain
+// lowercase letters.
+type KeyMode int8
+
+const (
+	STRIP_LOWERCASE = KeyMode(iota)		// Discard lowercase letters, as per FF[3]. This is the default.
+	NORMALISE_KEYS						// Use the FF[4] name for known long names, else discard lowercase.
+	VERBATIM_KEYS						// Keep the name exactly as written.
+)
+
+// long_keys maps long property names found in old files to their FF[4]
+// equivalents. Only names which do not already reduce to the right thing
+// when lowercase is discarded really need to be here, but it's clearer to
+// list them all.
+var long_keys = map[string]string{
+	"AddBlack":			"AB",
+	"AddEmpty":			"AE",
+	"AddWhite":			"AW",
+	"Annotation":		"AN",
+	"Annotator":		"AN",
+	"Application":		"AP",
+	"BadMove":			"BM",
+	"Black":			"B",
+	"BlackRank":		"BR",
+	"BlackTeam":		"BT",
+	"BlackTerritory":	"TB",
+	"BlackTimeLeft":	"BL",
+	"Charset":			"CA",
+	"Check":			"CH",
+	"Circle":			"CR",
+	"Comment":			"C",
+	"Copyright":		"CP",
+	"Date":				"DT",
+	"Doubtful":			"DO",
+	"Event":			"EV",
+	"EvenPosition":		"DM",
+	"Figure":			"FG",
+	"FileFormat":		"FF",
+	"Game":				"GM",
+	"GameComment":		"GC",
+	"GameName":			"GN",
+	"GoodForBlack":		"GB",
+	"GoodForWhite":		"GW",
+	"Handicap":			"HA",
+	"Hotspot":			"HO",
+	"Interesting":		"IT",
+	"Komi":				"KM",
+	"Label":			"LB",
+	"Mark":				"MA",
+	"MoveNumber":		"MN",
+	"Name":				"N",
+	"NodeName":			"N",
+	"Opening":			"ON",
+	"Overtime":			"OT",
+	"Place":			"PC",
+	"Player":			"PL",
+	"PlayerBlack":		"PB",
+	"PlayerWhite":		"PW",
+	"Result":			"RE",
+	"Round":			"RO",
+	"Rules":			"RU",
+	"Selected":			"SL",
+	"Size":				"SZ",
+	"Source":			"SO",
+	"Square":			"SQ",
+	"Tesuji":			"TE",
+	"TimeLimit":		"TM",
+	"Triangle":			"TR",
+	"Unclear":			"UC",
+	"User":				"US",
+	"Value":			"V",
+	"View":				"VW",
+	"White":			"W",
+	"WhiteRank":		"WR",
+	"WhiteTeam":		"WT",
+	"WhiteTerritory":	"TW",
+	"WhiteTimeLeft":	"WL",
+}
+
+// effective_key returns the key to store values under, given the key with
+// lowercase discarded (the traditional behaviour) and the key as written.
+// Rewrites are recorded in the decoder.
+func (self *Decoder) effective_key(stripped, raw string) string {
+
+	ret := stripped
+
+	switch self.opts.Keys {
+	case NORMALISE_KEYS:
+		if k, ok := long_keys[raw]; ok {
+			ret = k
+		}
+	case VERBATIM_KEYS:
+		ret = raw
+	}
+
+	if ret != raw && raw != "" {
+		if self.rewrites == nil {
+			self.rewrites = make(map[string]string)
+		}
+		self.rewrites[raw] = ret
+	}
+
+	return ret
+}
+
+// KeyRewrites returns a map of every property name which was changed during the
+// most recent call to Decode, from the name as written to the name used. See
+// LoadOptions.Keys for how names are changed.
+func (self *Decoder) KeyRewrites() map[string]string {
+	ret := make(map[string]string)
+	for k, v := range self.rewrites {
+		ret[k] = v
+	}
+	return ret
+}
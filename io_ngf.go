@@ -1,9 +1,10 @@
 package sgf
 
-// Basic NGF parser (i.e. for WBaduk files)
+// Basic NGF parser and writer (i.e. for WBaduk files)
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -154,3 +155,128 @@ func LoadNGF(ngf string) (*Node, error) {
 
 	return root, nil
 }
+
+// NGF returns the line of play through the node (i.e. its ancestors, then the
+// main line onwards) in NGF format. Comments, variations and passes are lost.
+// Player names are written with spaces replaced by underscores, and komi ending
+// in .5 is written as its whole part, since NGF implies a half point. Whole
+// number komi (including no KM at all, i.e. 0) can only be written the same
+// way, so it gains a half point when loaded back. An error is returned for
+// things NGF cannot represent: setup other than handicap stones in the standard
+// Tygem layout, and komi with more than one decimal place.
+func (self *Node) NGF() (string, error) {
+
+	root, handicap, moves, err := export_line(self)
+	if err != nil {
+		return "", err
+	}
+
+	size := root.RootBoardSize()
+
+	if len(handicap) > 0 && is_tygem_handicap(handicap, size) == false {
+		return "", fmt.Errorf("NGF(): handicap stones are not in the standard layout")
+	}
+
+	komi := "0"
+	if km, ok := root.GetValue("KM"); ok {
+		value, err := strconv.ParseFloat(strings.TrimSpace(km), 64)
+		if err == nil {
+			tenths := strconv.FormatFloat(value, 'f', 1, 64)			// The loader keeps only one decimal place.
+			if value == math.Floor(value) || value - math.Floor(value) == 0.5 {
+				komi = strconv.Itoa(int(math.Floor(value)))
+			} else if tenths == strconv.FormatFloat(value, 'f', -1, 64) {
+				komi = tenths
+			} else {
+				return "", fmt.Errorf("NGF(): can't represent komi %v", value)
+			}
+		}
+	}
+
+	if len(moves) > 26 * 26 - 1 {
+		return "", fmt.Errorf("NGF(): too many moves")
+	}
+
+	title, ok := root.GetValue("EV")
+	if ok == false {
+		title, _ = root.GetValue("GN")
+	}
+	if strings.TrimSpace(title) == "" {
+		title = "Game"				// Can't be blank, or the lines would be misnumbered when loading.
+	}
+
+	player := func(colour string) string {
+		name, _ := root.GetValue("P" + colour)
+		name = strings.Join(strings.Fields(name), "_")
+		if rank, _ := root.GetValue(colour + "R"); rank != "" && name != "" {
+			return fmt.Sprintf("%-11s %s*", name, strings.ToUpper(rank))
+		}
+		return name
+	}
+
+	date := ""
+	if dt, _ := root.GetValue("DT"); len(dt) >= 10 {
+		if parsed := parse_gib_date(dt[:10]); parsed != "" {
+			date = strings.Replace(parsed, "-", "", -1) + " [00:00]"
+		}
+	}
+
+	result := ""
+	if re, ok := root.GetValue("RE"); ok {
+		winner, margin := split_result(re)
+		if winner != EMPTY {
+			switch margin {
+			case "R":
+				result = winner.Word() + " wins by resignation"
+			case "T":
+				result = winner.Word() + " wins by time"
+			case "F":
+				result = winner.Word() + " wins by forfeit"
+			case "":
+				result = winner.Word() + " wins"
+			default:
+				result = winner.Word() + " wins by " + margin + " points"
+			}
+		}
+	}
+
+	place, _ := root.GetValue("PC")
+
+	lines := []string{
+		one_line(title),
+		strconv.Itoa(size),
+		player("W"),
+		player("B"),
+		one_line(place),
+		strconv.Itoa(len(handicap)),
+		"0",
+		komi,
+		date,
+		"0",
+		result,
+		strconv.Itoa(len(moves)),
+	}
+
+	for i, mv := range moves {
+
+		// Move numbers are 2 letters, from "AB" for 1. Coordinates are
+		// letters from "B" for 0, written as xy and then again as yx.
+
+		n := i + 1
+		x := byte(mv.x + 66)
+		y := byte(mv.y + 66)
+
+		lines = append(lines, string([]byte{'P', 'M', byte('A' + n / 26), byte('A' + n % 26), mv.colour.Upper()[0], x, y, y, x}))
+	}
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// SaveNGF saves the line of play through the node to the specified file, in NGF
+// format. See NGF for what is saved. Like Save, saving is atomic.
+func (self *Node) SaveNGF(filename string) error {
+	s, err := self.NGF()
+	if err != nil {
+		return err
+	}
+	return save_atomic(filename, write_string_to(s))
+}
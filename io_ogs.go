@@ -0,0 +1,418 @@
+package sgf
+
+// OGS (online-go.com) JSON parser
+//
+// The fields used are as found in OGS's game data, which may be the whole
+// document or inside a "gamedata" object. Moves are arrays [x, y, time], with
+// (-1, -1) being a pass and the time being milliseconds spent on the move.
+// Times in time_control are in seconds. With a handicap, Black's first moves
+// are the handicap stones, unless initial_state already has them.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ogs_game struct {
+	Gamedata			*ogs_game					`json:"gamedata"`
+	GameName			string						`json:"game_name"`
+	Name				string						`json:"name"`
+	Width				int							`json:"width"`
+	Height				int							`json:"height"`
+	Komi				json.RawMessage				`json:"komi"`
+	Handicap			int							`json:"handicap"`
+	Rules				string						`json:"rules"`
+	InitialPlayer		string						`json:"initial_player"`
+	InitialState		struct {
+		Black			string						`json:"black"`
+		White			string						`json:"white"`
+	}												`json:"initial_state"`
+	Moves				[][]json.RawMessage			`json:"moves"`
+	Players				struct {
+		Black			ogs_player					`json:"black"`
+		White			ogs_player					`json:"white"`
+	}												`json:"players"`
+	BlackPlayerID		int64						`json:"black_player_id"`
+	WhitePlayerID		int64						`json:"white_player_id"`
+	Winner				int64						`json:"winner"`
+	Outcome				string						`json:"outcome"`
+	StartTime			int64						`json:"start_time"`
+	TimeControl			ogs_time_control			`json:"time_control"`
+}
+
+type ogs_player struct {
+	Username			string						`json:"username"`
+	Rank				float64						`json:"rank"`
+	ID					int64						`json:"id"`
+}
+
+type ogs_time_control struct {
+	System				string						`json:"system"`
+	MainTime			float64						`json:"main_time"`
+	PeriodTime			float64						`json:"period_time"`
+	Periods				int							`json:"periods"`
+	InitialTime			float64						`json:"initial_time"`
+	TimeIncrement		float64						`json:"time_increment"`
+	MaxTime				float64						`json:"max_time"`
+	TotalTime			float64						`json:"total_time"`
+}
+
+// LoadOGSJSON parses an OGS JSON game record, creating a tree of SGF nodes, and
+// returns the root. The time left after each move is recorded in BL or WL (and
+// OB or OW, during byo-yomi), where the time control allows it to be worked
+// out. JSON which has none of the fields of an OGS record is an error.
+func LoadOGSJSON(s string) (*Node, error) {
+
+	var game ogs_game
+
+	err := json.Unmarshal([]byte(s), &game)
+	if err != nil {
+		return nil, fmt.Errorf("load_ogs_json(): %v", err)
+	}
+
+	// Any JSON object would unmarshal without error, so check that it has at
+	// least one of the fields an OGS record must have...
+
+	var top, inner map[string]json.RawMessage
+
+	json.Unmarshal([]byte(s), &top)						// Can't fail, given the above succeeded.
+	json.Unmarshal(top["gamedata"], &inner)				// Might fail, leaving inner nil, which is fine.
+
+	if ogs_fields_present(top) == false && ogs_fields_present(inner) == false {
+		return nil, fmt.Errorf("load_ogs_json(): not an OGS game record")
+	}
+
+	if game.Gamedata != nil {
+		outer := game
+		game = *game.Gamedata
+		if game.Players.Black.Username == "" && game.Players.White.Username == "" {
+			game.Players = outer.Players
+		}
+	}
+
+	size := game.Width
+	if size == 0 {
+		size = 19
+	}
+
+	if game.Height != 0 && game.Height != size {
+		return nil, fmt.Errorf("load_ogs_json(): can't handle non-square board %dx%d", game.Width, game.Height)
+	}
+
+	if size < 1 || size > 52 {
+		return nil, fmt.Errorf("load_ogs_json(): bad board size %d", size)
+	}
+
+	root := NewTree(size)
+
+	// Game info...
+
+	if game.GameName == "" {
+		game.GameName = game.Name
+	}
+	if name := strings.TrimSpace(game.GameName); name != "" {
+		root.SetValue("GN", name)
+	}
+
+	for _, item := range []struct{key string; player ogs_player}{{"B", game.Players.Black}, {"W", game.Players.White}} {
+		if item.player.Username != "" {
+			root.SetValue("P" + item.key, item.player.Username)
+		}
+		if rank := ogs_rank(item.player.Rank); rank != "" {
+			root.SetValue(item.key + "R", rank)
+		}
+	}
+
+	if game.StartTime > 0 {
+		root.SetValue("DT", time.Unix(game.StartTime, 0).UTC().Format("2006-01-02"))
+	}
+
+	if game.Rules != "" {
+		root.SetValue("RU", ogs_rules(game.Rules))
+	}
+
+	if komi, ok := json_float(game.Komi); ok {
+		root.SetValue("KM", strconv.FormatFloat(komi, 'f', -1, 64))
+	}
+
+	if re := ogs_result(&game); re != "" {
+		root.SetValue("RE", re)
+	}
+
+	clock := new_ogs_clock(game.TimeControl)
+	if tm, ot := clock.tm_ot(); tm != "" {
+		root.SetValue("TM", tm)
+		if ot != "" {
+			root.SetValue("OT", ot)
+		}
+	}
+
+	// Setup...
+
+	for _, item := range [][2]string{{"AB", game.InitialState.Black}, {"AW", game.InitialState.White}} {
+		for n := 0; n + 1 < len(item[1]); n += 2 {
+			if p := item[1][n:n + 2]; ValidPoint(p, size) {
+				root.AddValue(item[0], p)
+			}
+		}
+	}
+
+	// Moves...
+
+	colour := BLACK
+	if game.InitialPlayer == "white" {
+		colour = WHITE
+	}
+
+	if root.ValueCount("AB") > 0 || root.ValueCount("AW") > 0 {
+		root.SetValue("PL", colour.Upper())
+	}
+
+	handicap_moves := 0
+	if game.Handicap > 1 {
+		root.SetValue("HA", strconv.Itoa(game.Handicap))
+		if root.ValueCount("AB") == 0 {
+			handicap_moves = game.Handicap
+		}
+	}
+
+	clocks := map[Colour]*ogs_clock{BLACK: clock, WHITE: new_ogs_clock(game.TimeControl)}
+
+	node := root
+
+	for i, mv := range game.Moves {
+
+		if len(mv) < 2 {
+			return nil, fmt.Errorf("load_ogs_json(): bad move %d", i)
+		}
+
+		x, ok1 := json_float(mv[0])
+		y, ok2 := json_float(mv[1])
+		if ok1 == false || ok2 == false {
+			return nil, fmt.Errorf("load_ogs_json(): bad move %d", i)
+		}
+
+		p := ""
+		if x >= 0 && y >= 0 {
+			p = Point(int(x), int(y))
+			if ValidPoint(p, size) == false {
+				return nil, fmt.Errorf("load_ogs_json(): move %d is off the board", i)
+			}
+		}
+
+		if i < handicap_moves {
+			if p != "" {
+				root.AddValue("AB", p)
+			}
+			if i == handicap_moves - 1 {
+				colour = WHITE
+			}
+			continue
+		}
+
+		node = NewNode(node)
+		node.SetValue(colour.Upper(), p)
+
+		if len(mv) >= 3 {
+			if ms, ok := json_float(mv[2]); ok {
+				if left, periods, ok := clocks[colour].spend(ms / 1000); ok {
+					node.SetValue(colour.Upper() + "L", strconv.FormatFloat(left, 'f', -1, 64))
+					if periods > 0 {
+						node.SetValue("O" + colour.Upper(), strconv.Itoa(periods))
+					}
+				}
+			}
+		}
+
+		colour = colour.Opposite()
+	}
+
+	return root, nil
+}
+
+// json_float accepts a JSON number, or a string containing one, as some fields
+// (e.g. komi) are found both ways.
+func json_float(raw json.RawMessage) (float64, bool) {
+
+	var f float64
+	if json.Unmarshal(raw, &f) == nil {
+		return f, true
+	}
+
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+func ogs_fields_present(m map[string]json.RawMessage) bool {
+	for _, key := range []string{"moves", "width", "height", "players", "initial_state"} {
+		if _, ok := m[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func ogs_rank(rank float64) string {
+
+	// OGS ranks are numbers, with 30 being 1d and 29 being 1k.
+
+	if rank <= 0 {
+		return ""
+	}
+
+	n := int(math.Floor(rank))
+	if n >= 30 {
+		return strconv.Itoa(n - 29) + "d"
+	}
+	return strconv.Itoa(30 - n) + "k"
+}
+
+func ogs_rules(rules string) string {
+	switch strings.ToLower(rules) {
+	case "aga":
+		return "AGA"
+	case "nz":
+		return "NZ"
+	case "ing":
+		return "Ing"
+	}
+	return strings.ToUpper(rules[0:1]) + strings.ToLower(rules[1:])
+}
+
+func ogs_result(game *ogs_game) string {
+
+	var winner string
+
+	switch {
+	case game.Winner == 0:
+		return ""
+	case game.Winner == game.BlackPlayerID || game.Winner == game.Players.Black.ID:
+		winner = "B"
+	case game.Winner == game.WhitePlayerID || game.Winner == game.Players.White.ID:
+		winner = "W"
+	default:
+		return ""
+	}
+
+	outcome := strings.ToLower(strings.TrimSpace(game.Outcome))
+
+	switch {
+	case strings.HasPrefix(outcome, "resign"):
+		return winner + "+R"
+	case strings.HasPrefix(outcome, "timeout"):
+		return winner + "+T"
+	case strings.HasPrefix(outcome, "disqualification") || strings.HasPrefix(outcome, "abandon") || strings.HasPrefix(outcome, "cancel"):
+		return winner + "+F"
+	}
+
+	// Otherwise it's e.g. "6.5 points"...
+
+	if fields := strings.Fields(outcome); len(fields) > 0 {
+		if _, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			return winner + "+" + fields[0]
+		}
+	}
+
+	return winner + "+"
+}
+
+// -------------------------------------------------------------------------------------
+
+// ogs_clock tracks one player's time, so that the time left after each move can
+// be recorded.
+type ogs_clock struct {
+	tc					ogs_time_control
+	left				float64				// Seconds left, in main time or the current period.
+	periods				int					// Byo-yomi periods left.
+}
+
+func new_ogs_clock(tc ogs_time_control) *ogs_clock {
+
+	ret := &ogs_clock{tc: tc, periods: tc.Periods}
+
+	switch tc.System {
+	case "byoyomi":
+		ret.left = tc.MainTime
+	case "fischer":
+		ret.left = tc.InitialTime
+	case "absolute":
+		ret.left = tc.TotalTime
+	}
+
+	return ret
+}
+
+// tm_ot returns the SGF TM and OT values for the time control, or "" if there
+// are none.
+func (self *ogs_clock) tm_ot() (tm, ot string) {
+
+	format := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+
+	switch self.tc.System {
+	case "byoyomi":
+		return format(self.tc.MainTime), fmt.Sprintf("%dx%s byo-yomi", self.tc.Periods, format(self.tc.PeriodTime))
+	case "fischer":
+		return format(self.tc.InitialTime), fmt.Sprintf("%s fischer", format(self.tc.TimeIncrement))
+	case "absolute":
+		return format(self.tc.TotalTime), ""
+	}
+
+	return "", ""
+}
+
+// spend updates the clock for a move which took the given number of seconds,
+// and returns the time left and, if in byo-yomi, the periods left. The result
+// is not ok if the time control is not understood.
+func (self *ogs_clock) spend(seconds float64) (left float64, periods int, ok bool) {
+
+	switch self.tc.System {
+
+	case "byoyomi":
+
+		if self.left > 0 {
+			self.left -= seconds
+			if self.left >= 0 {
+				return round_time(self.left), 0, true
+			}
+			seconds = -self.left
+			self.left = 0
+		}
+
+		if self.tc.PeriodTime > 0 {
+			self.periods -= int(seconds / self.tc.PeriodTime)
+		}
+		if self.periods < 1 {
+			self.periods = 1				// The game would have ended otherwise.
+		}
+		return self.tc.PeriodTime, self.periods, true
+
+	case "fischer":
+
+		self.left -= seconds
+		self.left += self.tc.TimeIncrement
+		if self.tc.MaxTime > 0 && self.left > self.tc.MaxTime {
+			self.left = self.tc.MaxTime
+		}
+		return round_time(math.Max(self.left, 0)), 0, true
+
+	case "absolute":
+
+		self.left -= seconds
+		return round_time(math.Max(self.left, 0)), 0, true
+	}
+
+	return 0, 0, false
+}
+
+func round_time(seconds float64) float64 {
+	return math.Round(seconds * 1000) / 1000
+}
@@ -0,0 +1,450 @@
+package sgf
+
+// UGF parser and writer (i.e. for PandaNet / Igowin files, also UGI)
+//
+// The file is divided into sections. [Header] has KEY=VALUE lines, of which
+// these are used:
+//
+//		Title, Place, Date					Game name, place, and date, e.g. "2005/01/30"
+//		PlayerB, PlayerW					Name and rank, e.g. "foo,5d,," (the other fields are unknown)
+//		Size, Hdcp							Board size, and handicap with komi, e.g. "2,0.5"
+//		Rule								e.g. "JPN"
+//		Winner								Winner and margin, e.g. "B,C" (resignation) or "W,2.5"
+//		Writer, Copyright, Coment			User, copyright, and game comment (sic)
+//
+// [Data] has one line per move, e.g. "QD,B1,0" being the coordinates, colour
+// and move number, and time. Coordinates are letters from A, with the x axis
+// running left to right and the y axis bottom to top; offboard coordinates
+// (e.g. "YA") are passes. Move number 0 is used for setup (i.e. handicap)
+// stones.
+//
+// [Figure] has various commands starting with "."; the only ones used are
+// ".Text,n" and ".EndText", which enclose the comment on move n.
+//
+// Japanese files are usually Shift_JIS. Since this is not built in, such files
+// are only decoded if a Shift_JIS charset is available, see LoadUGFOptions.
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LoadUGF parses a UGF (or UGI) string, creating a tree of SGF nodes, and
+// returns the root. The string is used as it is; see LoadUGFOptions for
+// Shift_JIS input.
+func LoadUGF(ugf string) (*Node, error) {
+	return load_ugf(ugf)
+}
+
+// LoadUGFOptions is like LoadUGF, but unless opts.RawCharset is set, input that
+// is not valid UTF-8 is first decoded as Shift_JIS, provided a charset of that
+// name is supplied in opts.Charsets or registered (see RegisterCharset). In that
+// case the root is given CA[UTF-8]. If decoding fails, an error is returned,
+// unless opts.Recover is set, in which case the input is used as it is.
+func LoadUGFOptions(ugf string, opts LoadOptions) (*Node, error) {
+	return load_import(ugf, []string{"Shift_JIS"}, opts, load_ugf)
+}
+
+func load_ugf(ugf string) (*Node, error) {
+
+	header := make(map[string]string)
+	var data []string
+	texts := make(map[int][]string)
+
+	section := ""
+	text_move := -1
+
+	for _, line := range strings.Split(ugf, "\n") {
+
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+
+		// Inside a comment, lines are kept verbatim...
+
+		if text_move >= 0 {
+			if strings.HasPrefix(line, ".EndText") {
+				text_move = -1
+			} else {
+				if strings.HasPrefix(line, " ") && strings.HasPrefix(trimmed, ".") {
+					line = line[1:]						// See UGF() for why this space is there.
+				}
+				texts[text_move] = append(texts[text_move], line)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = strings.ToLower(trimmed)
+			continue
+		}
+
+		switch section {
+
+		case "[header]":
+			if eq := strings.Index(trimmed, "="); eq > 0 {
+				header[strings.ToLower(trimmed[:eq])] = strings.TrimSpace(trimmed[eq + 1:])
+			}
+
+		case "[data]":
+			if trimmed != "" {
+				data = append(data, trimmed)
+			}
+
+		case "[figure]":
+			if strings.HasPrefix(trimmed, ".Text,") {
+				fields := strings.Split(trimmed, ",")
+				n, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+				if err == nil && n >= 0 {
+					text_move = n
+					texts[n] = append(texts[n], "")		// Separates multiple texts for one move.
+				}
+			}
+		}
+	}
+
+	if len(data) == 0 && len(texts) == 0 {
+		return nil, fmt.Errorf("load_ugf(): no [Data] or [Figure] found")
+	}
+
+	size := 19
+	if sz, err := strconv.Atoi(header["size"]); err == nil && sz >= 1 && sz <= 26 {
+		size = sz
+	}
+
+	root := NewTree(size)
+
+	// Game info...
+
+	for _, item := range [][2]string{{"title", "GN"}, {"place", "PC"}, {"writer", "US"}, {"copyright", "CP"}, {"coment", "GC"}, {"comment", "GC"}} {
+		if val := header[item[0]]; val != "" {
+			root.SetValue(item[1], val)
+		}
+	}
+
+	if dt := parse_gib_date(strings.Split(header["date"], ",")[0]); dt != "" {
+		root.SetValue("DT", dt)
+	}
+
+	for _, colour := range []string{"B", "W"} {
+		fields := strings.Split(header["player" + strings.ToLower(colour)], ",")
+		if name := strings.TrimSpace(fields[0]); name != "" {
+			root.SetValue("P" + colour, name)
+		}
+		if len(fields) > 1 {
+			rank := strings.TrimSpace(fields[1])
+			if normalised := normalise_gib_rank(rank); normalised != "" {
+				rank = normalised
+			}
+			if rank != "" {
+				root.SetValue(colour + "R", rank)
+			}
+		}
+	}
+
+	if ru := parse_ugf_rules(header["rule"]); ru != "" {
+		root.SetValue("RU", ru)
+	}
+
+	if re := parse_ugf_winner(header["winner"]); re != "" {
+		root.SetValue("RE", re)
+	}
+
+	handicap := 0
+	if hdcp, ok := header["hdcp"]; ok {
+		fields := strings.Split(hdcp, ",")
+		handicap, _ = strconv.Atoi(strings.TrimSpace(fields[0]))
+		if len(fields) > 1 {
+			if _, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64); err == nil {
+				root.SetValue("KM", strings.TrimSpace(fields[1]))
+			}
+		}
+	}
+
+	if handicap > 1 {
+		root.SetValue("HA", strconv.Itoa(handicap))
+	}
+
+	// Moves. We note which node each move number went to, for the comments...
+
+	node := root
+	numbers := []int{0}
+	nodes := []*Node{root}
+
+	for _, line := range data {
+
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 || len(fields[0]) != 2 || len(fields[1]) < 2 {
+			continue
+		}
+
+		key := strings.ToUpper(fields[1][0:1])
+		if key != "B" && key != "W" {
+			continue
+		}
+
+		n, err := strconv.Atoi(fields[1][1:])
+		if err != nil {
+			continue
+		}
+
+		x := int(fields[0][0]) - 'A'
+		y := size - 1 - (int(fields[0][1]) - 'A')
+
+		onboard := x >= 0 && x < size && y >= 0 && y < size
+
+		if n == 0 {
+			if onboard {
+				root.AddValue("A" + key, Point(x, y))
+			}
+			continue
+		}
+
+		node = NewNode(node)
+		if onboard {
+			node.SetValue(key, Point(x, y))
+		} else {
+			node.SetValue(key, "")					// Pass
+		}
+
+		numbers = append(numbers, n)
+		nodes = append(nodes, node)
+	}
+
+	if handicap > 1 && root.ValueCount("AB") == 0 {
+		root.SetValues("AB", HandicapPoints(size, handicap, false))
+	}
+
+	// Comments. Each goes on the last node whose move number is not greater
+	// than its own...
+
+	var text_numbers []int
+	for n := range texts {
+		text_numbers = append(text_numbers, n)
+	}
+	sort.Ints(text_numbers)
+
+	for _, n := range text_numbers {
+
+		text := strings.TrimSpace(strings.Join(texts[n], "\n"))
+		if text == "" {
+			continue
+		}
+
+		target := root
+		for i, number := range numbers {
+			if number <= n {
+				target = nodes[i]
+			}
+		}
+
+		if existing, ok := target.GetValue("C"); ok {
+			text = existing + "\n\n" + text
+		}
+		target.SetValue("C", text)
+	}
+
+	return root, nil
+}
+
+func parse_ugf_rules(s string) string {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "JPN":
+		return "Japanese"
+	case "CHN":
+		return "Chinese"
+	case "KOR":
+		return "Korean"
+	}
+	return parse_gib_rules(s)
+}
+
+func parse_ugf_winner(s string) string {
+
+	fields := strings.Split(s, ",")
+
+	winner := strings.ToUpper(strings.TrimSpace(fields[0]))
+	margin := ""
+	if len(fields) > 1 {
+		margin = strings.ToUpper(strings.TrimSpace(fields[1]))
+	}
+
+	if winner == "D" {
+		return "0"
+	}
+	if winner != "B" && winner != "W" {
+		return ""
+	}
+
+	switch margin {
+	case "C", "R":								// C is for chuuoshi, i.e. resignation.
+		return winner + "+R"
+	case "T", "F":
+		return winner + "+" + margin
+	}
+
+	if _, err := strconv.ParseFloat(margin, 64); err == nil {
+		return winner + "+" + margin
+	}
+
+	return winner + "+"
+}
+
+// UGF returns the line of play through the node (i.e. its ancestors, then the
+// main line onwards) in UGF format, with comments. Variations are lost, and
+// comments on nodes without moves are joined to the comment of the previous
+// move. An error is returned if the line has setup after the root, which UGF
+// cannot represent.
+func (self *Node) UGF() (string, error) {
+
+	line := full_line(self)
+	root := line[0]
+	size := root.RootBoardSize()
+
+	if size > 24 {									// Beyond this, the pass coordinates would be on the board.
+		return "", fmt.Errorf("UGF(): can't represent board size %d", size)
+	}
+
+	coords := func(x, y int) string {
+		return string([]byte{byte('A' + x), byte('A' + size - 1 - y)})
+	}
+
+	var buf bytes.Buffer
+
+	header := func(key, val string) {
+		fmt.Fprintf(&buf, "%s=%s\n", key, one_line(val))
+	}
+
+	field := func(key string) string {				// For values inside comma-separated lists.
+		val, _ := root.GetValue(key)
+		return strings.Replace(one_line(val), ",", " ", -1)
+	}
+
+	buf.WriteString("[Header]\n")
+
+	if gn, ok := root.GetValue("GN"); ok { header("Title", gn) }
+	if pc, ok := root.GetValue("PC"); ok { header("Place", pc) }
+
+	if dt, _ := root.GetValue("DT"); len(dt) >= 10 {
+		if date := parse_gib_date(dt[:10]); date != "" {
+			header("Date", strings.Replace(date, "-", "/", -1))
+		}
+	}
+
+	if ru, ok := root.GetValue("RU"); ok {
+		switch strings.ToLower(ru) {
+		case "japanese":
+			ru = "JPN"
+		case "chinese":
+			ru = "CHN"
+		case "korean":
+			ru = "KOR"
+		}
+		header("Rule", ru)
+	}
+
+	header("PlayerB", field("PB") + "," + field("BR") + ",,")
+	header("PlayerW", field("PW") + "," + field("WR") + ",,")
+	header("Size", strconv.Itoa(size))
+	header("Hdcp", strconv.Itoa(root.RootHandicap()) + "," + field("KM"))
+
+	if re, ok := root.GetValue("RE"); ok {
+		winner, margin := split_result(re)
+		if winner != EMPTY {
+			if margin == "R" {
+				margin = "C"
+			}
+			header("Winner", strings.TrimSuffix(winner.Upper() + "," + margin, ","))
+		} else if strings.HasPrefix(re, "0") || strings.EqualFold(re, "Draw") || strings.EqualFold(re, "Jigo") {
+			header("Winner", "D")
+		}
+	}
+
+	if us, ok := root.GetValue("US"); ok { header("Writer", us) }
+	if cp, ok := root.GetValue("CP"); ok { header("Copyright", cp) }
+	if gc, ok := root.GetValue("GC"); ok { header("Coment", gc) }
+
+	// Moves, noting the comments as we go...
+
+	buf.WriteString("[Data]\n")
+
+	for _, key := range []string{"AB", "AW"} {
+		for _, value := range root.AllValues(key) {
+			points := ParsePointList(value, size)
+			if points == nil {
+				points = []string{value}
+			}
+			for _, p := range points {
+				if x, y, onboard := ParsePoint(p, size); onboard {
+					fmt.Fprintf(&buf, "%s,%s0,0\n", coords(x, y), key[1:])
+				}
+			}
+		}
+	}
+
+	var texts []string								// Indexed by move number.
+	n := 0
+
+	for i, node := range line {
+
+		for _, key := range []string{"AB", "AW", "AE"} {
+			if (i > 0 || key == "AE") && node.ValueCount(key) > 0 {
+				return "", fmt.Errorf("UGF(): can't represent %s property", key)
+			}
+		}
+
+		for _, key := range []string{"B", "W"} {
+			value, ok := node.GetValue(key)
+			if ok == false {
+				continue
+			}
+			n++
+			if x, y, onboard := ParsePoint(value, size); onboard {
+				fmt.Fprintf(&buf, "%s,%s%d,0\n", coords(x, y), key, n)
+			} else {
+				fmt.Fprintf(&buf, "YA,%s%d,0\n", key, n)		// Pass, as an offboard point.
+			}
+		}
+
+		for len(texts) <= n {
+			texts = append(texts, "")
+		}
+
+		if c, ok := node.GetValue("C"); ok && strings.TrimSpace(c) != "" {
+			if texts[n] != "" {
+				texts[n] += "\n\n"
+			}
+			texts[n] += strings.TrimSpace(c)
+		}
+	}
+
+	buf.WriteString("[Figure]\n")
+
+	for n, text := range texts {
+		if text == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, ".Text,%d\n", n)
+		for _, s := range strings.Split(text, "\n") {
+			if strings.HasPrefix(strings.TrimSpace(s), ".") {
+				s = " " + s							// So it can't be taken for a command.
+			}
+			buf.WriteString(strings.TrimRight(s, "\r") + "\n")
+		}
+		buf.WriteString(".EndText\n")
+	}
+
+	return buf.String(), nil
+}
+
+// SaveUGF saves the line of play through the node to the specified file, in UGF
+// format. See UGF for what is saved. Like Save, saving is atomic.
+func (self *Node) SaveUGF(filename string) error {
+	s, err := self.UGF()
+	if err != nil {
+		return err
+	}
+	return save_atomic(filename, write_string_to(s))
+}
@@ -0,0 +1,426 @@
+package sgf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// WriteOptions adjusts the output of the SGF writer. The zero value gives the
+// normal output, with each tree on a single line. None of the layout options
+// affect the values themselves, which are always written byte-for-byte.
+type WriteOptions struct {
+
+	// If Charset is set, values are converted from UTF-8 to the named
+	// character set (see RegisterCharset) and the root's CA property is
+	// written accordingly. Charsets supplied here are used in preference to
+	// registered ones.
+
+	Charset			string
+	Charsets		map[string]Charset
+
+	// Layout. If NodesPerLine is non-zero, a new line is started after that
+	// many nodes. If Indent is set, each variation starts on a new line,
+	// indented by Indent once per level of nesting. If MaxWidth is non-zero,
+	// lines are broken between properties or values so as not to exceed that
+	// many bytes, where possible.
+
+	NodesPerLine	int
+	Indent			string
+	MaxWidth		int
+
+	// If OrderProperties is set, each node's properties are written with root
+	// and game info properties first, then moves and setup, then anything else
+	// (e.g. comments), then markup. Otherwise the order is as stored.
+
+	OrderProperties	bool
+
+	// If Canonical is set, semantically identical trees produce identical
+	// output: keys are sorted, point lists are expanded into single points and
+	// sorted (or compressed, if CompressPoints is also set), other lists are
+	// sorted, and tt passes are written as B[] or W[]. Layout and ordering
+	// options are ignored.
+
+	Canonical		bool
+
+	// If CompressPoints is set, point lists (e.g. AB, AW, AE and markup such
+	// as TR) are written using SGF rectangles (e.g. "dd:fg") where possible.
+
+	CompressPoints	bool
+
+	// If Context is set, writing is abandoned (with the context's error) once
+	// the context is done. When saving to a file, the file is then untouched.
+
+	Context			context.Context
+}
+
+func (self *WriteOptions) pretty() bool {
+	if self.Canonical {
+		return false
+	}
+	return self.NodesPerLine > 0 || self.Indent != "" || self.MaxWidth > 0
+}
+
+type tree_writer struct {
+	w				io.Writer
+	opts			WriteOptions
+	charset			Charset							// nil if no conversion is needed.
+	col				int								// Bytes written on the current line.
+	size			int								// Board size of the tree being written.
+	err				error							// First error from the underlying writer.
+}
+
+func new_tree_writer(w io.Writer, opts WriteOptions) (*tree_writer, error) {
+
+	ret := &tree_writer{w: w, opts: opts}
+
+	if opts.Charset != "" {
+		cs, ok := lookup_charset(opts.Charset, opts.Charsets)
+		if ok == false {
+			return nil, fmt.Errorf("new_tree_writer(): unknown charset %q", opts.Charset)
+		}
+		if _, is_utf8 := cs.(utf8_charset); is_utf8 == false {
+			ret.charset = cs
+		}
+	}
+
+	return ret, nil
+}
+
+func (self *tree_writer) write_tree(root *Node) error {
+
+	self.size = root.RootBoardSize()
+
+	err := self.write_subtree(root, 0)
+	if err != nil {
+		return err
+	}
+
+	if self.opts.pretty() {
+		self.newline(0)
+	}
+
+	return self.err
+}
+
+func (self *tree_writer) write_subtree(local_root *Node, depth int) error {
+
+	if depth > 0 && self.opts.pretty() && self.opts.Indent != "" {
+		self.newline(depth)
+	}
+
+	node := local_root
+	count := 0
+
+	for {
+		if self.err != nil {
+			return self.err
+		}
+		if self.opts.Context != nil {
+			if err := self.opts.Context.Err(); err != nil {
+				return err
+			}
+		}
+		if self.opts.pretty() && self.opts.NodesPerLine > 0 && count > 0 && count % self.opts.NodesPerLine == 0 {
+			self.newline(depth)
+		}
+		pieces, err := self.node_pieces(node)
+		if err != nil {
+			return err
+		}
+		if node == local_root {
+			pieces[0] = "(" + pieces[0]				// So a line never ends with the ( alone.
+		}
+		for _, piece := range pieces {
+			self.put(piece, depth)
+		}
+		count++
+		if len(node.children) > 1 {
+			for _, child := range node.children {
+				err = self.write_subtree(child, depth + 1)
+				if err != nil {
+					return err
+				}
+			}
+			break
+		} else if len(node.children) == 1 {
+			node = node.children[0]
+			continue
+		} else {
+			break
+		}
+	}
+
+	self.put(")", depth)
+
+	return nil
+}
+
+// put writes a piece of output that must not itself be broken, first starting
+// a new line if that's needed to respect the maximum width.
+func (self *tree_writer) put(piece string, depth int) {
+	if self.opts.pretty() && self.opts.MaxWidth > 0 && self.col > 0 && self.col + len(piece) > self.opts.MaxWidth {
+		self.newline(depth)
+	}
+	self.write(piece)
+	self.col += len(piece)
+}
+
+func (self *tree_writer) newline(depth int) {
+	if self.col == 0 {
+		return
+	}
+	indent := strings.Repeat(self.opts.Indent, depth)
+	self.write("\n" + indent)
+	self.col = len(indent)
+}
+
+func (self *tree_writer) write(s string) {
+	if self.err != nil {
+		return
+	}
+	_, self.err = io.WriteString(self.w, s)
+}
+
+// node_pieces returns the node in SGF format, split into pieces between which
+// line breaks are allowed: each property with its first value, and each further
+// value. The first piece starts with the node's ; character.
+func (self *tree_writer) node_pieces(node *Node) ([]string, error) {
+
+	props := node.props
+
+	set_ca := self.charset != nil && node.parent == nil		// Declare the charset in the root.
+
+	if set_ca {
+		props = with_charset(props, self.opts.Charset)		// Before sorting, so CA lands in its proper place.
+	}
+
+	if self.opts.Canonical {
+		props = canonical_props(props, self.size)
+	} else if self.opts.OrderProperties {
+		props = ordered_props(props)
+	}
+
+	if self.opts.CompressPoints {
+		props = compressed_props(props, self.size)
+	}
+
+	var ret []string
+
+	for _, slice := range props {
+
+		for i, value := range slice[1:] {
+			if self.charset != nil {
+				encoded, err := self.charset.Encode(value)
+				if err != nil {
+					return nil, err
+				}
+				value = string(encoded)
+			}
+			piece := "[" + escape_string(value) + "]"
+			if i == 0 {
+				piece = slice[0] + piece
+			}
+			ret = append(ret, piece)
+		}
+	}
+
+	if len(ret) == 0 {
+		return []string{";"}, nil
+	}
+
+	ret[0] = ";" + ret[0]
+	return ret, nil
+}
+
+func (self *tree_writer) node_bytes(node *Node) ([]byte, error) {
+
+	pieces, err := self.node_pieces(node)
+	if err != nil {
+		return nil, err
+	}
+
+	b := bytes.NewBuffer(make([]byte, 0, 8))		// Start buffer with len 0 cap 8
+	for _, piece := range pieces {
+		b.WriteString(piece)
+	}
+
+	return b.Bytes(), nil
+}
+
+// with_charset returns a new props slice (not a deep copy) with CA set to the
+// given charset name, in place of any existing CA, or at the end.
+func with_charset(props [][]string, name string) [][]string {
+
+	ret := make([][]string, 0, len(props) + 1)
+	found := false
+
+	for _, slice := range props {
+		if slice[0] == "CA" {
+			ret = append(ret, []string{"CA", name})
+			found = true
+		} else {
+			ret = append(ret, slice)
+		}
+	}
+
+	if found == false {
+		ret = append(ret, []string{"CA", name})
+	}
+
+	return ret
+}
+
+// -------------------------------------------------------------------------------------
+
+var prop_classes = map[string]int{
+
+	// 0: root and game info.
+
+	"GM": 0, "FF": 0, "CA": 0, "AP": 0, "ST": 0, "SZ": 0,
+	"AN": 0, "BR": 0, "BT": 0, "CP": 0, "DT": 0, "EV": 0, "GN": 0, "GC": 0, "HA": 0, "KM": 0, "ON": 0,
+	"OT": 0, "PB": 0, "PC": 0, "PW": 0, "RE": 0, "RO": 0, "RU": 0, "SO": 0, "TM": 0, "US": 0, "WR": 0, "WT": 0,
+
+	// 1: moves and setup.
+
+	"B": 1, "W": 1, "KO": 1, "MN": 1, "BL": 1, "WL": 1, "OB": 1, "OW": 1,
+	"AB": 1, "AW": 1, "AE": 1, "PL": 1,
+
+	// 2: anything else, e.g. comments and annotations.
+
+	// 3: markup.
+
+	"AR": 3, "CR": 3, "DD": 3, "LB": 3, "LN": 3, "MA": 3, "SL": 3, "SQ": 3, "TR": 3, "TB": 3, "TW": 3, "VW": 3,
+}
+
+func prop_class(key string) int {
+	if class, ok := prop_classes[key]; ok {
+		return class
+	}
+	return 2
+}
+
+// ordered_props returns a sorted copy of the props slice (not a deep copy), in
+// order of class, but otherwise as stored.
+func ordered_props(props [][]string) [][]string {
+	ret := make([][]string, len(props))
+	copy(ret, props)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return prop_class(ret[i][0]) < prop_class(ret[j][0])
+	})
+	return ret
+}
+
+var point_list_keys = map[string]bool{
+	"AB": true, "AW": true, "AE": true, "CR": true, "DD": true, "MA": true,
+	"SL": true, "SQ": true, "TB": true, "TR": true, "TW": true, "VW": true,
+}
+
+// canonical_props returns a new props slice, with keys sorted, point lists
+// expanded and sorted, other lists sorted, and tt passes written as empty.
+func canonical_props(props [][]string, size int) [][]string {
+
+	ret := make([][]string, 0, len(props))
+
+	for _, slice := range props {
+
+		key := slice[0]
+		var values []string
+
+		if key == "B" || key == "W" {
+			for _, value := range slice[1:] {
+				if value == "tt" && size <= 19 {
+					values = append(values, "")			// The old way of writing a pass.
+				} else {
+					values = append(values, value)		// Other junk is kept, so as not to hide differences.
+				}
+			}
+		} else if point_list_keys[key] {
+			seen := make(map[string]bool)
+			for _, value := range slice[1:] {
+				points := ParsePointList(value, size)
+				if points == nil {
+					points = []string{value}
+				}
+				for _, point := range points {
+					if seen[point] == false {
+						seen[point] = true
+						values = append(values, point)
+					}
+				}
+			}
+		} else {
+			values = append(values, slice[1:]...)
+		}
+
+		sort.Strings(values)
+		ret = append(ret, append([]string{key}, values...))
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i][0] < ret[j][0]
+	})
+
+	return ret
+}
+
+// compressed_props returns a new props slice (not a deep copy) where point lists
+// use rectangles where possible.
+func compressed_props(props [][]string, size int) [][]string {
+
+	ret := make([][]string, len(props))
+
+	for i, slice := range props {
+		if point_list_keys[slice[0]] == false {
+			ret[i] = slice
+			continue
+		}
+		var points []string
+		for _, value := range slice[1:] {
+			if expanded := ParsePointList(value, size); expanded != nil {
+				points = append(points, expanded...)
+			} else {
+				points = append(points, value)
+			}
+		}
+		ret[i] = append([]string{slice[0]}, CompressPoints(points, size)...)
+	}
+
+	return ret
+}
+
+// expand_point_lists replaces any rectangles in the node's point lists with the
+// single points they represent.
+func expand_point_lists(node *Node, size int) {
+
+	// We adjust the props directly, which is only safe since this is used on
+	// fresh trees with no board caches (and the board is unchanged anyway).
+
+	for ki, slice := range node.props {
+
+		if point_list_keys[slice[0]] == false {
+			continue
+		}
+
+		values := []string{slice[0]}
+		seen := make(map[string]bool)
+
+		for _, value := range slice[1:] {
+			points := ParsePointList(value, size)
+			if points == nil {
+				points = []string{value}
+			}
+			for _, point := range points {
+				if seen[point] == false {
+					seen[point] = true
+					values = append(values, point)
+				}
+			}
+		}
+
+		node.props[ki] = values
+	}
+}
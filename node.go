@@ -1,8 +1,6 @@
 package sgf
 
 import (
-	"bytes"
-	"fmt"
 	"io"
 )
 
@@ -62,23 +60,8 @@ func (self *Node) Copy() *Node {
 // WriteTo writes the node in SGF format to an io.Writer. This method
 // instantiates io.WriterTo for no particularly good reason.
 func (self *Node) WriteTo(w io.Writer) (n int64, err error) {
-
-	b := bytes.NewBuffer(make([]byte, 0, 8))		// Start buffer with len 0 cap 8
-
-	b.WriteByte(';')
-
-	for _, slice := range self.props {
-
-		b.WriteString(slice[0])
-
-		for _, value := range slice[1:] {
-			b.WriteByte('[')
-			b.WriteString(escape_string(value))
-			b.WriteByte(']')
-		}
-	}
-
-	count, err := fmt.Fprint(w, b.String())
+	b, _ := (&tree_writer{}).node_bytes(self)			// Can't fail with no charset.
+	count, err := w.Write(b)
 	return int64(count), err
 }
 
@@ -9,6 +9,9 @@ package sgf
 // created; the error is still nil. On failure, the original node is returned,
 // along with an error. Failure indicates the move was illegal.
 //
+// Legality is judged by the rules named in the root's RU property (see
+// Node.Rules), including superko where those rules call for it.
+//
 // Note that passes cannot be played with Play.
 func (self *Node) Play(p string) (*Node, error) {
 	return self.PlayColour(p, self.Board().Player)							// Uses board info to determine colour.
@@ -18,7 +21,7 @@ func (self *Node) Play(p string) (*Node, error) {
 // automatically determined.
 func (self *Node) PlayColour(p string, colour Colour) (*Node, error) {		// Returns new node on success; self on failure.
 
-	legal, err := self.Board().LegalColour(p, colour)
+	legal, err := self.LegalWithRules(p, colour, self.Rules())
 	if legal == false {
 		return self, err
 	}
@@ -90,7 +90,8 @@ func (self *Node) String() string {
 }
 
 // Validate checks a node for obvious problems; it returns the first problem
-// found as an error, otherwise it returns nil.
+// found as an error, otherwise it returns nil. Move legality is judged by the
+// rules named in the root's RU property (see Node.Rules).
 func (self *Node) Validate() error {
 
 	all_b := self.AllValues("B")
@@ -110,11 +111,12 @@ func (self *Node) Validate() error {
 	if self.parent != nil {
 
 		board := self.parent.Board()
+		rules := self.Rules()
 
 		if len(all_b) > 0 {
 			mv := all_b[0]
 			if ValidPoint(mv, board.Size) {
-				legal, err := board.LegalColour(mv, BLACK)
+				legal, err := self.parent.LegalWithRules(mv, BLACK, rules)
 				if legal == false {
 					return err
 				}
@@ -126,7 +128,7 @@ func (self *Node) Validate() error {
 		if len(all_w) > 0 {
 			mv := all_w[0]
 			if ValidPoint(mv, board.Size) {
-				legal, err := board.LegalColour(mv, WHITE)
+				legal, err := self.parent.LegalWithRules(mv, WHITE, rules)
 				if legal == false {
 					return err
 				}
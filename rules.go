@@ -0,0 +1,188 @@
+package sgf
+
+import (
+	"fmt"
+	"strings"
+)
+
+type KoRule int8
+
+const (
+	SIMPLE_KO = KoRule(iota)			// Only the immediate recapture (Board.Ko) is forbidden.
+	POSITIONAL_SUPERKO					// No move may repeat an earlier arrangement of stones.
+	SITUATIONAL_SUPERKO					// As above, but only with the same player to move.
+)
+
+// String returns a description of the ko rule, e.g. "positional superko".
+func (self KoRule) String() string {
+	switch self {
+	case SIMPLE_KO:
+		return "simple ko"
+	case POSITIONAL_SUPERKO:
+		return "positional superko"
+	case SITUATIONAL_SUPERKO:
+		return "situational superko"
+	}
+	return "unknown ko rule"
+}
+
+type Scoring int8
+
+const (
+	TERRITORY_SCORING = Scoring(iota)	// Territory plus prisoners, e.g. Japanese.
+	AREA_SCORING						// Territory plus stones on the board, e.g. Chinese.
+)
+
+// String returns a description of the scoring method, e.g. "area".
+func (self Scoring) String() string {
+	switch self {
+	case TERRITORY_SCORING:
+		return "territory"
+	case AREA_SCORING:
+		return "area"
+	}
+	return "unknown scoring"
+}
+
+type HandicapBonus int8
+
+const (
+	HANDICAP_BONUS_NONE = HandicapBonus(iota)	// No compensation for handicap stones.
+	HANDICAP_BONUS_N							// White gets 1 point per handicap stone, e.g. Chinese.
+	HANDICAP_BONUS_N_MINUS_1					// White gets 1 point per handicap stone after the first, e.g. AGA.
+)
+
+// Rules holds a rule set. The zero value is equivalent to JapaneseRules, apart
+// from the name, and matches the library's traditional behaviour: suicide is
+// forbidden and only simple ko is enforced.
+type Rules struct {
+	Name				string				// As it would appear in RU, e.g. "Chinese".
+	Suicide				bool				// Whether suicide (of one stone or more) is a legal move.
+	Ko					KoRule
+	Scoring				Scoring
+	HandicapBonus		HandicapBonus
+
+	// If PassStones is set, a player who passes gives the opponent a prisoner,
+	// as in the AGA rules. This is applied by Board.Pass and by passes in B / W.
+
+	PassStones			bool
+}
+
+var JapaneseRules    = Rules{Name: "Japanese"}
+var KoreanRules      = Rules{Name: "Korean"}
+var ChineseRules     = Rules{Name: "Chinese",      Ko: POSITIONAL_SUPERKO,  Scoring: AREA_SCORING, HandicapBonus: HANDICAP_BONUS_N}
+var AGARules         = Rules{Name: "AGA",          Ko: SITUATIONAL_SUPERKO, Scoring: AREA_SCORING, HandicapBonus: HANDICAP_BONUS_N_MINUS_1, PassStones: true}
+var NZRules          = Rules{Name: "NZ",           Ko: SITUATIONAL_SUPERKO, Scoring: AREA_SCORING, Suicide: true}
+var TrompTaylorRules = Rules{Name: "Tromp-Taylor", Ko: POSITIONAL_SUPERKO,  Scoring: AREA_SCORING, Suicide: true}
+
+// ParseRules returns the rule set named by an RU value, e.g. "Chinese", "AGA",
+// "NZ" or "Tromp-Taylor". Some common variations are understood, including
+// OGS and Tygem / Fox spellings. The second return value is false if the name
+// was not recognised, in which case JapaneseRules are returned.
+func ParseRules(ru string) (Rules, bool) {
+
+	s := strings.ToLower(strings.TrimSpace(ru))
+	s = strings.NewReplacer("-", "", "_", "", " ", "").Replace(s)
+
+	switch s {
+	case "japanese", "jp", "jpn", "japan":
+		return JapaneseRules, true
+	case "korean", "kor", "korea":
+		return KoreanRules, true
+	case "chinese", "cn", "chn", "china":
+		return ChineseRules, true
+	case "aga", "american":
+		return AGARules, true
+	case "nz", "newzealand":
+		return NZRules, true
+	case "tromptaylor", "tt":
+		return TrompTaylorRules, true
+	}
+
+	// Try the more liberal matching used for GIB files...
+
+	switch parse_gib_rules(ru) {
+	case "Japanese":
+		return JapaneseRules, true
+	case "Korean":
+		return KoreanRules, true
+	case "Chinese":
+		return ChineseRules, true
+	}
+
+	return JapaneseRules, false
+}
+
+// Rules returns the rule set named by the root's RU property, or JapaneseRules
+// if it is absent or not recognised.
+func (self *Node) Rules() Rules {
+	ru, _ := self.GetRoot().GetValue("RU")
+	rules, _ := ParseRules(ru)
+	return rules
+}
+
+// HandicapCompensation returns the number of points White receives for the
+// given number of handicap stones.
+func (self Rules) HandicapCompensation(handicap int) int {
+	if handicap < 2 {
+		return 0
+	}
+	switch self.HandicapBonus {
+	case HANDICAP_BONUS_N:
+		return handicap
+	case HANDICAP_BONUS_N_MINUS_1:
+		return handicap - 1
+	}
+	return 0
+}
+
+// LegalWithRules is like Board.LegalColour, called on the node's board with the
+// given rules in place of its own, but additionally applies superko, if the
+// rule set calls for it. The position after the move is compared against the
+// position at every node in the line leading to this one (via Zobrist hashes,
+// see Board.Hash). If false, the reason is given in the error.
+func (self *Node) LegalWithRules(p string, colour Colour, rules Rules) (bool, error) {
+
+	board := self.Board()
+	board.Rules = rules
+
+	legal, err := board.LegalColour(p, colour)
+	if legal == false {
+		return false, err
+	}
+
+	if rules.Ko != POSITIONAL_SUPERKO && rules.Ko != SITUATIONAL_SUPERKO {
+		return true, nil
+	}
+
+	after := board.Copy()
+	after.ForceStone(p, colour)
+
+	situational := rules.Ko == SITUATIONAL_SUPERKO
+	target := superko_hash(after, situational)
+
+	// Board() above filled the cache of every node in the line, so we can walk up
+	// it once, reading the cached boards' hashes without copying or replaying...
+
+	depth := 0
+	for node := self.parent; node != nil; node = node.parent {
+		depth++
+	}
+
+	for node := self; node != nil; node = node.parent {
+		if superko_hash(node.__board_cache, situational) == target {
+			return false, fmt.Errorf("%v: move at %q repeats position at depth %d", rules.Ko, p, depth)
+		}
+		depth--
+	}
+
+	return true, nil
+}
+
+func superko_hash(board *Board, situational bool) uint64 {
+	h := board.StoneHash()
+	if situational && board.Player == WHITE {
+		h ^= zobrist_white_to_move
+	}
+	return h
+}
@@ -0,0 +1,182 @@
+package sgf
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// A Score is the result of counting a finished position, as returned by
+// Board.Score and Node.Score. Maps are keyed by BLACK and WHITE.
+type Score struct {
+	Rules				Rules
+	Komi				float64
+	HandicapBonus		int						// Points given to White for handicap stones, see Rules.
+
+	Territory			map[Colour]int			// Empty points surrounded, after dead stones are removed.
+	Stones				map[Colour]int			// Live stones on the board.
+	Prisoners			map[Colour]int			// Captures (from Board.CapturesBy) plus dead stones.
+
+	Total				map[Colour]float64		// Including komi and handicap bonus, for White.
+	Margin				float64					// Black's total minus White's; positive if Black wins.
+}
+
+// Score counts the position, treating the groups containing the given points
+// as dead (any one stone of each dead group is enough). Dead stones are removed
+// and added to the prisoners of the other player. An empty region counts as
+// territory if it touches only one colour; under territory scoring, this
+// includes eyes in seki, which Japanese rules would not count.
+//
+// Since a board doesn't know the handicap, no handicap bonus is given; see
+// Node.Score for that.
+func (self *Board) Score(rules Rules, komi float64, dead ...string) *Score {
+	return self.score(rules, komi, 0, dead, nil)
+}
+
+// Score counts the position at the node, using the rules from the root's RU,
+// and the komi and handicap from KM and HA. If the node has TB or TW markup,
+// that decides the territory, and stones inside the other player's territory
+// are dead. Otherwise all stones are taken to be alive.
+func (self *Node) Score() *Score {
+
+	board := self.Board()
+	rules := self.Rules()
+	bonus := rules.HandicapCompensation(self.RootHandicap())
+
+	tb := point_values(self, "TB", board.Size)
+	tw := point_values(self, "TW", board.Size)
+
+	if len(tb) == 0 && len(tw) == 0 {
+		return board.score(rules, self.RootKomi(), bonus, nil, nil)
+	}
+
+	marked := make(map[string]Colour)
+	var dead []string
+
+	for _, item := range []struct{points []string; colour Colour}{{tb, BLACK}, {tw, WHITE}} {
+		for _, p := range item.points {
+			marked[p] = item.colour
+			if board.Get(p) == item.colour.Opposite() {
+				dead = append(dead, p)
+			}
+		}
+	}
+
+	return board.score(rules, self.RootKomi(), bonus, dead, marked)
+}
+
+func (self *Board) score(rules Rules, komi float64, bonus int, dead []string, marked map[string]Colour) *Score {
+
+	ret := &Score{
+		Rules:			rules,
+		Komi:			komi,
+		HandicapBonus:	bonus,
+		Territory:		map[Colour]int{BLACK: 0, WHITE: 0},
+		Stones:			map[Colour]int{BLACK: 0, WHITE: 0},
+		Prisoners:		map[Colour]int{BLACK: self.CapturesBy[BLACK], WHITE: self.CapturesBy[WHITE]},
+		Total:			map[Colour]float64{BLACK: 0, WHITE: 0},
+	}
+
+	work := self.Copy()
+
+	for _, p := range dead {
+		colour := work.Get(p)
+		if colour == BLACK || colour == WHITE {
+			ret.Prisoners[colour.Opposite()] += work.DestroyGroup(p)
+		}
+	}
+
+	for x := 0; x < work.Size; x++ {
+		for y := 0; y < work.Size; y++ {
+			if work.State[x][y] == BLACK || work.State[x][y] == WHITE {
+				ret.Stones[work.State[x][y]]++
+			}
+		}
+	}
+
+	if marked != nil {
+		for p, colour := range marked {
+			if work.Get(p) == EMPTY {
+				ret.Territory[colour]++
+			}
+		}
+	} else {
+		for _, region := range work.empty_regions() {
+			if owner := work.region_owner(region); owner != EMPTY {
+				ret.Territory[owner] += len(region)
+			}
+		}
+	}
+
+	for _, colour := range []Colour{BLACK, WHITE} {
+		if rules.Scoring == AREA_SCORING {
+			ret.Total[colour] = float64(ret.Territory[colour] + ret.Stones[colour])
+		} else {
+			ret.Total[colour] = float64(ret.Territory[colour] + ret.Prisoners[colour])
+		}
+	}
+
+	ret.Total[WHITE] += komi + float64(bonus)
+	ret.Margin = ret.Total[BLACK] - ret.Total[WHITE]
+
+	return ret
+}
+
+// empty_regions returns every connected region of empty points.
+func (self *Board) empty_regions() [][]string {
+
+	var ret [][]string
+	touched := make(map[string]bool)
+
+	for x := 0; x < self.Size; x++ {
+		for y := 0; y < self.Size; y++ {
+			p := Point(x, y)
+			if self.State[x][y] == EMPTY && touched[p] == false {
+				ret = append(ret, self.stones_recurse(p, EMPTY, touched, nil))
+			}
+		}
+	}
+
+	return ret
+}
+
+// region_owner returns the only colour adjacent to the region, or EMPTY if it
+// touches both colours, or neither.
+func (self *Board) region_owner(region []string) Colour {
+
+	seen := map[Colour]bool{}
+
+	for _, p := range region {
+		for _, a := range AdjacentPoints(p, self.Size) {
+			seen[self.get_fast(a)] = true
+		}
+	}
+
+	if seen[BLACK] && seen[WHITE] == false {
+		return BLACK
+	}
+	if seen[WHITE] && seen[BLACK] == false {
+		return WHITE
+	}
+	return EMPTY
+}
+
+// Result returns the score as an SGF RE value, e.g. "B+3.5", or "0" for a draw.
+func (self *Score) Result() string {
+	if self.Margin > 0 {
+		return "B+" + strconv.FormatFloat(self.Margin, 'f', -1, 64)
+	}
+	if self.Margin < 0 {
+		return "W+" + strconv.FormatFloat(-self.Margin, 'f', -1, 64)
+	}
+	return "0"
+}
+
+// String returns a summary of the score, e.g. "B+3.5 (Black 80, White 76.5; area)".
+func (self *Score) String() string {
+	return fmt.Sprintf("%s (Black %v, White %v; %v)", self.Result(), self.Total[BLACK], self.Total[WHITE], self.Rules.Scoring)
+}
+
+// SetResult writes the score's result into the root's RE property.
+func (self *Node) SetResult(score *Score) {
+	self.GetRoot().SetValue("RE", score.Result())
+}
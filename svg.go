@@ -0,0 +1,355 @@
+package sgf
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SVGOptions adjusts the output of Board.SVG and Node.SVG. The zero value gives
+// reasonable defaults.
+type SVGOptions struct {
+	CellSize		int				// Distance between lines, in pixels. Default 24.
+	Background		string			// Board colour, in any SVG format. Default "#dcb35c".
+	Coordinates		bool			// Draw coordinates, in GTP style (e.g. "D16").
+
+	// LastMove is a point to mark as the last move, if any. Node.SVG uses the
+	// node's own move if this is not set.
+
+	LastMove		string
+
+	// For Node.SVG, if MoveNumbers is positive, the stones of that many of the
+	// most recent moves leading to the node are numbered (counting from the
+	// start of the game). If negative, all moves are numbered. Stones which
+	// were later captured are not shown, nor are their numbers.
+
+	MoveNumbers		int
+}
+
+// SVG returns an SVG diagram of the board, including the ko square (if any) and
+// the last move, if given in the options.
+func (self *Board) SVG(opts SVGOptions) string {
+	return new_svg_diagram(self, opts).render()
+}
+
+// SVG returns an SVG diagram of the board at the node, with the node's markup
+// (TR, CR, SQ, MA, SL and LB), the ko square (if any), the last move, and
+// optionally move numbers.
+func (self *Node) SVG(opts SVGOptions) string {
+
+	board := self.Board()
+	d := new_svg_diagram(board, opts)
+
+	if d.opts.LastMove == "" {
+		for _, key := range []string{"B", "W"} {
+			if mv, ok := self.GetValue(key); ok && ValidPoint(mv, board.Size) {
+				d.opts.LastMove = mv
+			}
+		}
+	}
+
+	if d.opts.MoveNumbers != 0 {
+		d.add_move_numbers(self)
+	}
+
+	d.add_markup(self)
+
+	return d.render()
+}
+
+// -------------------------------------------------------------------------------------
+
+type svg_diagram struct {
+	board			*Board
+	opts			SVGOptions
+	shapes			map[string]string		// Point --> "TR", "CR", "SQ" or "MA"
+	selected		map[string]bool
+	labels			map[string]string		// Point --> text, from LB or move numbers
+	caption			[]string				// Lines of text below the board.
+}
+
+func new_svg_diagram(board *Board, opts SVGOptions) *svg_diagram {
+
+	if opts.CellSize <= 0 {
+		opts.CellSize = 24
+	}
+	if opts.Background == "" {
+		opts.Background = "#dcb35c"
+	}
+
+	return &svg_diagram{
+		board:		board,
+		opts:		opts,
+		shapes:		make(map[string]string),
+		selected:	make(map[string]bool),
+		labels:		make(map[string]string),
+	}
+}
+
+func (self *svg_diagram) add_markup(node *Node) {
+
+	size := self.board.Size
+
+	for _, key := range []string{"TR", "CR", "SQ", "MA"} {
+		for _, p := range point_values(node, key, size) {
+			self.shapes[p] = key
+		}
+	}
+
+	for _, p := range point_values(node, "SL", size) {
+		self.selected[p] = true
+	}
+
+	for _, value := range node.AllValues("LB") {
+		if len(value) >= 3 && value[2] == ':' && ValidPoint(value[:2], size) {
+			self.labels[value[:2]] = value[3:]
+		}
+	}
+}
+
+func (self *svg_diagram) add_move_numbers(node *Node) {
+
+	type numbered_move struct {
+		p				string
+		colour			Colour
+		number			int
+	}
+
+	var moves []numbered_move
+	size := self.board.Size
+
+	for _, n := range node.GetLine() {
+		for _, key := range []string{"B", "W"} {
+			if mv, ok := n.GetValue(key); ok {
+				colour := BLACK; if key == "W" { colour = WHITE }
+				moves = append(moves, numbered_move{mv, colour, len(moves) + 1})
+			}
+		}
+	}
+
+	if self.opts.MoveNumbers > 0 && len(moves) > self.opts.MoveNumbers {
+		moves = moves[len(moves) - self.opts.MoveNumbers:]
+	}
+
+	// Later moves at the same point overwrite earlier ones. The stone must still
+	// be there, of the right colour, else the move was captured...
+
+	for _, mv := range moves {
+		if ValidPoint(mv.p, size) && self.board.Get(mv.p) == mv.colour {
+			self.labels[mv.p] = strconv.Itoa(mv.number)
+		}
+	}
+}
+
+func (self *svg_diagram) render() string {
+
+	var buf bytes.Buffer
+
+	size := self.board.Size
+	c := float64(self.opts.CellSize)
+
+	margin := c
+	if self.opts.Coordinates {
+		margin = c * 2
+	}
+
+	width := margin * 2 + c * float64(size - 1)
+	height := width
+
+	line_height := c * 0.75
+	if len(self.caption) > 0 {
+		height += line_height * float64(len(self.caption)) + c * 0.25
+	}
+
+	// Pixel location of a board coordinate...
+
+	at := func(n int) float64 {
+		return margin + c * float64(n)
+	}
+
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%s" height="%s" viewBox="0 0 %s %s">` + "\n",
+		svg_num(width), svg_num(height), svg_num(width), svg_num(height))
+	fmt.Fprintf(&buf, `<rect width="100%%" height="100%%" fill="%s"/>` + "\n", xml_escape(self.opts.Background))
+
+	// Grid...
+
+	var path bytes.Buffer
+	for n := 0; n < size; n++ {
+		fmt.Fprintf(&path, "M%s %sH%s", svg_num(at(0)), svg_num(at(n)), svg_num(at(size - 1)))
+		fmt.Fprintf(&path, "M%s %sV%s", svg_num(at(n)), svg_num(at(0)), svg_num(at(size - 1)))
+	}
+	fmt.Fprintf(&buf, `<path d="%s" stroke="black" stroke-width="1" fill="none"/>` + "\n", path.String())
+
+	// Hoshi...
+
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			if IsStarPoint(Point(x, y), size) {
+				fmt.Fprintf(&buf, `<circle cx="%s" cy="%s" r="%s" fill="black"/>` + "\n", svg_num(at(x)), svg_num(at(y)), svg_num(c * 0.1))
+			}
+		}
+	}
+
+	// Coordinates, GTP style, so there's no "I" and the numbers go upwards...
+
+	if self.opts.Coordinates && size <= 25 {
+		for n := 0; n < size; n++ {
+			letter := GTP(Point(n, size - 1), size)
+			letter = letter[:1]
+			number := strconv.Itoa(size - n)
+			self.text(&buf, at(n), c, letter, "black", c * 0.45)
+			self.text(&buf, c, at(n), number, "black", c * 0.45)
+		}
+	}
+
+	// Stones...
+
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			switch self.board.State[x][y] {
+			case BLACK:
+				fmt.Fprintf(&buf, `<circle cx="%s" cy="%s" r="%s" fill="black"/>` + "\n",
+					svg_num(at(x)), svg_num(at(y)), svg_num(c * 0.48))
+			case WHITE:
+				fmt.Fprintf(&buf, `<circle cx="%s" cy="%s" r="%s" fill="white" stroke="black" stroke-width="1"/>` + "\n",
+					svg_num(at(x)), svg_num(at(y)), svg_num(c * 0.48 - 0.5))
+			}
+		}
+	}
+
+	// Selection, drawn as a translucent overlay...
+
+	for _, p := range self.points() {
+		x, y, _ := ParsePoint(p, size)
+		if self.selected[p] {
+			fmt.Fprintf(&buf, `<rect x="%s" y="%s" width="%s" height="%s" fill="#3050ff" fill-opacity="0.35"/>` + "\n",
+				svg_num(at(x) - c / 2), svg_num(at(y) - c / 2), svg_num(c), svg_num(c))
+		}
+	}
+
+	// Ko square...
+
+	if x, y, onboard := ParsePoint(self.board.Ko, size); onboard && self.board.State[x][y] == EMPTY {
+		if _, marked := self.shapes[self.board.Ko]; marked == false && self.labels[self.board.Ko] == "" {
+			fmt.Fprintf(&buf, `<rect x="%s" y="%s" width="%s" height="%s" fill="none" stroke="black" stroke-width="1.5"/>` + "\n",
+				svg_num(at(x) - c * 0.25), svg_num(at(y) - c * 0.25), svg_num(c * 0.5), svg_num(c * 0.5))
+		}
+	}
+
+	// Last move, unless something else is drawn there...
+
+	if x, y, onboard := ParsePoint(self.opts.LastMove, size); onboard && self.board.State[x][y] != EMPTY {
+		if _, marked := self.shapes[self.opts.LastMove]; marked == false && self.labels[self.opts.LastMove] == "" {
+			fmt.Fprintf(&buf, `<circle cx="%s" cy="%s" r="%s" fill="none" stroke="%s" stroke-width="2"/>` + "\n",
+				svg_num(at(x)), svg_num(at(y)), svg_num(c * 0.25), self.ink(x, y))
+		}
+	}
+
+	// Markup...
+
+	for _, p := range self.points() {
+
+		x, y, _ := ParsePoint(p, size)
+
+		px, py, ink := at(x), at(y), self.ink(x, y)
+		r := c * 0.3
+
+		switch self.shapes[p] {			// Does nothing if there's no shape.
+		case "TR":
+			fmt.Fprintf(&buf, `<polygon points="%s,%s %s,%s %s,%s" fill="none" stroke="%s" stroke-width="1.5"/>` + "\n",
+				svg_num(px), svg_num(py - r), svg_num(px - r * 0.866), svg_num(py + r / 2), svg_num(px + r * 0.866), svg_num(py + r / 2), ink)
+		case "CR":
+			fmt.Fprintf(&buf, `<circle cx="%s" cy="%s" r="%s" fill="none" stroke="%s" stroke-width="1.5"/>` + "\n",
+				svg_num(px), svg_num(py), svg_num(r * 0.85), ink)
+		case "SQ":
+			fmt.Fprintf(&buf, `<rect x="%s" y="%s" width="%s" height="%s" fill="none" stroke="%s" stroke-width="1.5"/>` + "\n",
+				svg_num(px - r * 0.7), svg_num(py - r * 0.7), svg_num(r * 1.4), svg_num(r * 1.4), ink)
+		case "MA":
+			fmt.Fprintf(&buf, `<path d="M%s %sL%s %sM%s %sL%s %s" stroke="%s" stroke-width="1.5"/>` + "\n",
+				svg_num(px - r * 0.7), svg_num(py - r * 0.7), svg_num(px + r * 0.7), svg_num(py + r * 0.7),
+				svg_num(px - r * 0.7), svg_num(py + r * 0.7), svg_num(px + r * 0.7), svg_num(py - r * 0.7), ink)
+		}
+	}
+
+	for _, p := range self.points() {
+
+		x, y, _ := ParsePoint(p, size)
+		if self.labels[p] == "" {
+			continue
+		}
+
+		// On empty points, blank out the lines behind the text...
+
+		if self.board.State[x][y] == EMPTY {
+			fmt.Fprintf(&buf, `<circle cx="%s" cy="%s" r="%s" fill="%s"/>` + "\n",
+				svg_num(at(x)), svg_num(at(y)), svg_num(c * 0.4), xml_escape(self.opts.Background))
+		}
+
+		font_size := c * 0.5
+		if len(self.labels[p]) > 2 {
+			font_size = c * 0.4
+		}
+
+		self.text(&buf, at(x), at(y), self.labels[p], self.ink(x, y), font_size)
+	}
+
+	for i, line := range self.caption {
+		fmt.Fprintf(&buf, `<text x="%s" y="%s" fill="black" font-family="sans-serif" font-size="%s">%s</text>` + "\n",
+			svg_num(margin - c / 2), svg_num(width - c / 2 + line_height * float64(i + 1)), svg_num(c * 0.5), xml_escape(line))
+	}
+
+	buf.WriteString("</svg>\n")
+
+	return buf.String()
+}
+
+// points returns every point on the board, in a fixed order, so that the
+// output doesn't depend on map iteration order.
+func (self *svg_diagram) points() []string {
+	var ret []string
+	for y := 0; y < self.board.Size; y++ {
+		for x := 0; x < self.board.Size; x++ {
+			ret = append(ret, Point(x, y))
+		}
+	}
+	return ret
+}
+
+// ink returns the colour to draw markup in at the given point.
+func (self *svg_diagram) ink(x, y int) string {
+	if self.board.State[x][y] == BLACK {
+		return "white"
+	}
+	return "black"
+}
+
+func (self *svg_diagram) text(buf *bytes.Buffer, x, y float64, s string, ink string, font_size float64) {
+	fmt.Fprintf(buf, `<text x="%s" y="%s" fill="%s" font-family="sans-serif" font-size="%s" text-anchor="middle" dominant-baseline="central">%s</text>` + "\n",
+		svg_num(x), svg_num(y), ink, svg_num(font_size), xml_escape(s))
+}
+
+func svg_num(f float64) string {
+	return strconv.FormatFloat(math.Round(f * 100) / 100, 'f', -1, 64)
+}
+
+var xml_replacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;")
+
+func xml_escape(s string) string {
+	return xml_replacer.Replace(s)
+}
+
+// point_values returns the points in the node's values for the key, with any
+// rectangles expanded, and invalid points skipped.
+func point_values(node *Node, key string, size int) []string {
+	var ret []string
+	for _, value := range node.AllValues(key) {
+		if points := ParsePointList(value, size); points != nil {
+			ret = append(ret, points...)
+		} else if ValidPoint(value, size) {
+			ret = append(ret, value)
+		}
+	}
+	return ret
+}
@@ -223,6 +223,77 @@ func ParsePointList(s string, size int) []string {
 	return ret
 }
 
+// CompressPoints takes a slice of SGF coordinates (e.g. "dd") and a board size,
+// and returns an equivalent slice using SGF rectangles (e.g. "dd:fg") where
+// possible. Rectangles are found greedily, which gives the minimal result in
+// the common cases. Strings that are not points on the board are returned
+// unchanged, at the end.
+func CompressPoints(points []string, size int) []string {
+
+	grid := make([][]bool, size)
+	for x := 0; x < size; x++ {
+		grid[x] = make([]bool, size)
+	}
+
+	var others []string
+
+	for _, p := range points {
+		x, y, onboard := ParsePoint(p, size)
+		if onboard {
+			grid[x][y] = true
+		} else {
+			others = append(others, p)
+		}
+	}
+
+	var ret []string
+
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+
+			if grid[x][y] == false {
+				continue
+			}
+
+			// Extend right as far as possible, then down while the whole row is present.
+
+			x2 := x
+			for x2 + 1 < size && grid[x2 + 1][y] {
+				x2++
+			}
+
+			y2 := y
+			for y2 + 1 < size {
+				full := true
+				for i := x; i <= x2; i++ {
+					if grid[i][y2 + 1] == false {
+						full = false
+						break
+					}
+				}
+				if full == false {
+					break
+				}
+				y2++
+			}
+
+			for i := x; i <= x2; i++ {
+				for j := y; j <= y2; j++ {
+					grid[i][j] = false
+				}
+			}
+
+			if x == x2 && y == y2 {
+				ret = append(ret, Point(x, y))
+			} else {
+				ret = append(ret, Point(x, y) + ":" + Point(x2, y2))
+			}
+		}
+	}
+
+	return append(ret, others...)
+}
+
 // ParseGTP takes a GTP formatted string (e.g. "D16") and a board size, and
 // returns the SGF coordinate (e.g. "dd") or "" if invalid.
 func ParseGTP(s string, size int) string {
@@ -258,6 +329,23 @@ func ParseGTP(s string, size int) string {
 	return Point(x, y)
 }
 
+// GTP takes an SGF coordinate (e.g. "dd") and a board size, and returns the GTP
+// vertex (e.g. "D16") or "" if invalid. Board sizes over 25 have no GTP
+// vertices.
+func GTP(p string, size int) string {
+
+	x, y, onboard := ParsePoint(p, size)
+	if onboard == false || size > 25 {
+		return ""
+	}
+
+	letter := byte('A' + x)
+	if letter >= 'I' {			// Adjust for missing "I"
+		letter++
+	}
+
+	return byte_to_string(letter) + strconv.Itoa(size - y)
+}
 
 // LoadArgOrQuit loads the filename given in os.Args[n] and returns the root
 // node. If this is not possible, the program exits.